@@ -0,0 +1,88 @@
+package actions
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// adminHandler serves the admin endpoints, which reveal too much about the app's internals to be public: profiling
+// (/debug/pprof, where /debug/pprof/goroutine?debug=2 dumps every goroutine), expvar (/debug/vars), the runtime config
+// with secrets redacted (/debug/config), session revocation (DELETE /sessions), and the health and metrics endpoints with
+// no token needed.
+func (app *App) adminHandler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(RequestID)
+	r.Use(middleware.Recoverer)
+	r.Get("/healthz", app.HealthzGET)
+	r.Get("/readyz", app.ReadyzGET)
+	r.Method(http.MethodGet, "/metrics", app.metrics.Handler(""))
+	r.Get("/debug/config", app.ConfigGET)
+	r.Delete("/sessions", app.SessionsDELETE)
+	r.Mount("/debug", middleware.Profiler())
+	return r
+}
+
+// adminListenAddr returns the address to listen on for the given ADMIN_ADDR, binding to localhost if it has no host
+// (e.g. ":6060") so that the admin endpoints are only exposed beyond the machine deliberately.
+func adminListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid admin address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// ConfigGET handles GET /debug/config on the admin listener, showing the config the app is running with.
+func (app *App) ConfigGET(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	jsonEncoder{}.Encode(w, redactConfig(reflect.ValueOf(app.conf)))
+}
+
+// redactConfig converts a config struct to a map for display, replacing the values of secrets, which are identified
+// by field names containing "Secret", "Key", "Password" or "Token", with "REDACTED". Values with a String method
+// (durations, log levels, etc.) are shown as their string.
+func redactConfig(v reflect.Value) map[string]any {
+	m := map[string]any{}
+	for i := range v.NumField() {
+		f := v.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		switch {
+		case isSecretField(f.Name):
+			if !fv.IsZero() {
+				m[f.Name] = "REDACTED"
+			} else {
+				m[f.Name] = ""
+			}
+		case fv.Kind() == reflect.Struct:
+			m[f.Name] = redactConfig(fv)
+		default:
+			if s, ok := fv.Interface().(fmt.Stringer); ok {
+				m[f.Name] = s.String()
+			} else {
+				m[f.Name] = fv.Interface()
+			}
+		}
+	}
+	return m
+}
+
+func isSecretField(name string) bool {
+	for _, s := range []string{"Secret", "Key", "Password", "Token"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdminServer validates that the admin endpoints are served on their own listener, and only there.
+func TestAdminServer(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c := conf
+	c.AdminAddr = "127.0.0.1:0"
+	c.SessionSecret = "super-secret"
+	app, err := NewApp(c, WithUserStore(models.NewMemoryUserStore()), WithListener(l))
+	require.NoError(t, err)
+	require.NoError(t, app.Start())
+	defer func() { assert.NoError(t, app.Stop(context.Background())) }()
+
+	adminURL := "http://" + app.adminSrv.Addr
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=2", "/debug/vars", "/metrics", "/readyz"} {
+		resp, err := http.Get(adminURL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+
+		resp, err = http.Get("http://" + l.Addr().String() + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		if path != "/readyz" {
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, "%s isn't public", path)
+		}
+	}
+
+	resp, err := http.Get(adminURL + "/debug/config")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var config map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+	assert.Equal(t, "REDACTED", config["SessionSecret"])
+	assert.Equal(t, c.SiteURL, config["SiteURL"])
+	assert.Equal(t, "10s", config["DBConfig"].(map[string]any)["QueryTimeout"])
+}
+
+func TestAdminListenAddr(t *testing.T) {
+	addr, err := adminListenAddr(":6060")
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:6060", addr)
+
+	addr, err = adminListenAddr("0.0.0.0:6060")
+	require.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:6060", addr)
+
+	_, err = adminListenAddr("6060")
+	assert.Error(t, err)
+}
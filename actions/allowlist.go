@@ -0,0 +1,71 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/markbates/goth"
+)
+
+// validateAllowlist checks the login restrictions make sense together.
+func (conf Config) validateAllowlist() error {
+	if conf.RequireGoogleHD && len(conf.AllowedEmailDomains) == 0 {
+		return fmt.Errorf("REQUIRE_GOOGLE_HD needs ALLOWED_EMAIL_DOMAINS to say which Google Workspace domains to allow")
+	}
+	return nil
+}
+
+// loginDenial returns why someone who logged in with the given provider isn't allowed in, or "" if they are. email is
+// the address they've verified, if any.
+//
+// Anyone may log in unless AllowedEmails or AllowedEmailDomains is set, in which case their email must be listed or be
+// in one of the domains. With RequireGoogleHD, Google logins in one of the domains must also be from an account managed
+// by that domain's Google Workspace, as personal Google accounts can have any address. provider is nil when checking a
+// user who's already logged in, whose Google account can't be checked again.
+func (conf Config) loginDenial(provider *AuthProvider, user goth.User, email string) string {
+	if len(conf.AllowedEmails) == 0 && len(conf.AllowedEmailDomains) == 0 {
+		return ""
+	}
+	if email == "" {
+		return "no verified email address"
+	}
+	for _, allowed := range conf.AllowedEmails {
+		if strings.EqualFold(email, strings.TrimSpace(allowed)) {
+			return ""
+		}
+	}
+
+	_, domain, _ := strings.Cut(email, "@")
+	for _, allowed := range conf.AllowedEmailDomains {
+		if !strings.EqualFold(domain, strings.TrimPrefix(strings.TrimSpace(allowed), "@")) {
+			continue
+		}
+		if conf.RequireGoogleHD && provider != nil && provider.Name == "google" {
+			if hd, _ := user.RawData["hd"].(string); !strings.EqualFold(hd, domain) {
+				return "Google account not managed by " + domain
+			}
+		}
+		return ""
+	}
+	return "email address not allowed"
+}
+
+// userDenial returns why the given user, who logged in earlier or has an API token, isn't allowed in anymore, or "" if
+// they still are. This keeps the allowlist applying to existing sessions and tokens when it's tightened.
+func (conf Config) userDenial(u *models.User) string {
+	return conf.loginDenial(nil, goth.User{}, u.Email)
+}
+
+// googleHostedDomain is the hd parameter to send Google when RequireGoogleHD is set, so it only offers accounts that
+// could be allowed in: the domain if there's one, or "*" for any Workspace account if there are several.
+func (conf Config) googleHostedDomain() string {
+	switch {
+	case !conf.RequireGoogleHD:
+		return ""
+	case len(conf.AllowedEmailDomains) == 1:
+		return strings.TrimPrefix(strings.TrimSpace(conf.AllowedEmailDomains[0]), "@")
+	default:
+		return "*"
+	}
+}
@@ -0,0 +1,150 @@
+package actions
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoginDenial validates which logins the allowlist and Google Workspace checks let in, and why they deny the rest.
+func TestLoginDenial(t *testing.T) {
+	google := &AuthProvider{Name: "google"}
+	github := &AuthProvider{Name: "github"}
+	restricted := Config{AllowedEmails: []string{"contractor@gmail.com"}, AllowedEmailDomains: []string{"example.com", " @example.org"}}
+	withHD := restricted
+	withHD.RequireGoogleHD = true
+	workspace := goth.User{RawData: map[string]any{"hd": "example.com"}}
+
+	tests := []struct {
+		name       string
+		conf       Config
+		provider   *AuthProvider
+		user       goth.User
+		email      string
+		wantDenial string
+	}{
+		{"unrestricted", Config{}, github, goth.User{}, "anyone@anywhere.com", ""},
+		{"unrestricted without email", Config{}, github, goth.User{}, "", ""},
+		{"allowed email", restricted, github, goth.User{}, "Contractor@gmail.com", ""},
+		{"allowed domain", restricted, github, goth.User{}, "ada@EXAMPLE.com", ""},
+		{"second domain", restricted, github, goth.User{}, "ada@example.org", ""},
+		{"other domain", restricted, github, goth.User{}, "ada@gmail.com", "email address not allowed"},
+		{"subdomain", restricted, github, goth.User{}, "ada@evil.example.com", "email address not allowed"},
+		{"no verified email", restricted, github, goth.User{}, "", "no verified email address"},
+		{"Google without hd check", restricted, google, goth.User{}, "ada@example.com", ""},
+		{"Google Workspace account", withHD, google, workspace, "ada@example.com", ""},
+		{"personal Google account", withHD, google, goth.User{}, "ada@example.com", "Google account not managed by example.com"},
+		{"other Workspace", withHD, google, goth.User{RawData: map[string]any{"hd": "example.org"}}, "ada@example.com", "Google account not managed by example.com"},
+		{"hd check is only for Google", withHD, github, goth.User{}, "ada@example.com", ""},
+		{"allowed email skips hd check", withHD, google, goth.User{}, "contractor@gmail.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantDenial, tt.conf.loginDenial(tt.provider, tt.user, tt.email))
+		})
+	}
+
+	assert.Equal(t, "", restricted.googleHostedDomain())
+	assert.Equal(t, "*", withHD.googleHostedDomain())
+	assert.Equal(t, "example.com", Config{RequireGoogleHD: true, AllowedEmailDomains: []string{"example.com"}}.googleHostedDomain())
+	assert.ErrorContains(t, Config{RequireGoogleHD: true}.validateAllowlist(), "needs ALLOWED_EMAIL_DOMAINS")
+}
+
+// TestLoginRejected validates that logins from outside the allowed domains get a page saying so, are logged as security
+// events, and don't create users.
+func TestLoginRejected(t *testing.T) {
+	t.Parallel()
+	issuer := newFakeOIDCIssuer(t, "kbexample")
+	var logs syncBuffer
+	logger, err := NewLogger(&logs, "json", slog.LevelInfo)
+	require.NoError(t, err)
+	c := conf
+	c.EnforceAuth = true
+	c.OIDCClientID = "kbexample"
+	c.OIDCIssuerURL = issuer.URL
+	c.AllowedEmailDomains = []string{"example.com"}
+	users := models.NewMemoryUserStore()
+	f := newFixture(t, c, WithUserStore(users), WithLogger(logger))
+	defer f.Cleanup()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	f.Client.Client = &http.Client{Jar: jar}
+
+	issuer.claims = map[string]any{"sub": "1", "name": "Eve", "email": "eve@gmail.com", "email_verified": true}
+	req, err := http.NewRequest(http.MethodGet, "/auth?provider=oidc", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html", "a page even for clients that asked for JSON")
+	page, err := f.Client.GetPage("/login")
+	require.NoError(t, err)
+	assert.NotContains(t, page, "Eve", "not logged in")
+	all, err := users.GetUsers(t.Context(), models.UserQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, all.Items, "no user was created")
+	assert.Contains(t, logs.String(), `"security_event":"login_rejected"`)
+	assert.Contains(t, logs.String(), `"email":"eve@gmail.com"`)
+
+	issuer.claims = map[string]any{"sub": "2", "name": "Ada", "email": "ada@example.com", "email_verified": true}
+	page, err = f.Client.GetPage("/auth?provider=oidc")
+	require.NoError(t, err)
+	assert.Contains(t, page, "Ada")
+	assert.Equal(t, 1, strings.Count(logs.String(), "login_rejected"))
+}
+
+// TestAllowlistTightened validates that sessions and API tokens stop working once the allowlist no longer lets their
+// user in, e.g. because ALLOWED_EMAIL_DOMAINS was tightened since they were issued.
+func TestAllowlistTightened(t *testing.T) {
+	t.Parallel()
+	c := conf
+	c.AllowedEmailDomains = []string{"example.com"}
+	f := newRBACFixture(t, c)
+	defer f.Cleanup()
+
+	// newUser creates an editor who logged in with the given email, and an API token for them.
+	newUser := func(name, email string) (*models.User, string) {
+		login := models.Login{Provider: "github", ProviderUserID: name, Email: email, Name: name}
+		u, err := f.Users.LoginUser(t.Context(), login)
+		require.NoError(t, err)
+		require.NoError(t, f.Users.SetUserRoles(t.Context(), u.ID, []string{"editor"}))
+		secret, token := models.NewAPIToken(u.ID, "script", []string{models.PermissionUsersRead}, nil)
+		_, err = f.Users.CreateAPIToken(t.Context(), token)
+		require.NoError(t, err)
+		return u, secret
+	}
+	ada, adaSecret := newUser("Ada", "ada@example.com")
+	eve, eveSecret := newUser("Eve", "eve@gmail.com")
+	// call lists users with the given bearer token, returning the response status.
+	call := func(secret string) int {
+		req, err := http.NewRequest(http.MethodGet, f.URL("/users"), nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	f.Login(ada)
+	page, err := f.Client.GetPage("/users")
+	require.NoError(t, err)
+	assert.Contains(t, page, "Eve")
+	assert.Equal(t, http.StatusOK, call(adaSecret))
+
+	f.Login(eve)
+	page, err = f.Client.GetPage("/users")
+	require.NoError(t, err, "redirected to the login page")
+	assert.NotContains(t, page, "Eve", "logged out")
+	assert.Equal(t, http.StatusUnauthorized, call(eveSecret))
+}
@@ -2,9 +2,13 @@ package actions
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -13,67 +17,216 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/katabole/kbexample/models"
 	"github.com/katabole/kbsession"
-	"github.com/markbates/goth"
-	"github.com/markbates/goth/gothic"
-	"github.com/markbates/goth/providers/google"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/unrolled/secure"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type Config struct {
 	ServerAddr    string        `envconfig:"SERVER_ADDR"`
 	SessionSecret string        `envconfig:"SESSION_SECRET"`
+	SessionKeys   SessionKeys   `envconfig:"SESSION_KEYS"`
 	DeployEnv     Environment   `envconfig:"DEPLOY_ENV"`
 	EnforceAuth   bool          `envconfig:"ENFORCE_AUTH"`
 	SiteURL       string        `envconfig:"SITE_URL"`
 	DBConfig      models.Config `envconfig:"DB"`
 
-	GoogleOAuthKey    string `envconfig:"GOOGLE_OAUTH_KEY"`
-	GoogleOAuthSecret string `envconfig:"GOOGLE_OAUTH_SECRET"`
+	// SessionStore is where session data is kept: "cookie" (the default) keeps it all in the client's cookie, while
+	// "postgres" keeps it in the database so sessions can be revoked. SessionCleanupInterval is how often expired
+	// sessions are deleted from the database, or zero to never delete them, e.g. when a cron job does.
+	SessionStore           string        `envconfig:"SESSION_STORE" default:"cookie"`
+	SessionCleanupInterval time.Duration `envconfig:"SESSION_CLEANUP_INTERVAL" default:"1h"`
+
+	// DefaultRole is the role of users who haven't been given any, e.g. "viewer", or none if empty.
+	// BootstrapAdminEmail is the email of the user made an admin when they log in, if there isn't an admin yet.
+	DefaultRole         string `envconfig:"DEFAULT_ROLE" default:"viewer"`
+	BootstrapAdminEmail string `envconfig:"BOOTSTRAP_ADMIN_EMAIL"`
+
+	// AllowedEmails and AllowedEmailDomains, when either is set, restrict who can log in to those emails and the emails
+	// in those domains, e.g. "example.com". RequireGoogleHD makes Google logins in the domains also prove they're from
+	// the domain's Google Workspace. See loginDenial.
+	AllowedEmails       []string `envconfig:"ALLOWED_EMAILS"`
+	AllowedEmailDomains []string `envconfig:"ALLOWED_EMAIL_DOMAINS"`
+	RequireGoogleHD     bool     `envconfig:"REQUIRE_GOOGLE_HD"`
+
+	// AdminAddr enables a second listener for the admin endpoints (profiling, metrics, etc., see admin.go) when set.
+	// It's bound to localhost unless it has a host, e.g. ":6060" only listens on localhost but "0.0.0.0:6060" doesn't.
+	AdminAddr string `envconfig:"ADMIN_ADDR"`
+
+	// LogFormat is the format of the logs, "text" or "json", and LogLevel the minimum level logged, e.g. "debug".
+	LogFormat string     `envconfig:"LOG_FORMAT" default:"text"`
+	LogLevel  slog.Level `envconfig:"LOG_LEVEL" default:"info"`
+
+	// TraceExporter enables OpenTelemetry tracing when set, exporting spans with "otlp" (configured by the standard
+	// OTEL_EXPORTER_OTLP_* variables), or for local use to "stdout" or a "file" at TraceFile.
+	TraceExporter string `envconfig:"TRACE_EXPORTER"`
+	TraceFile     string `envconfig:"TRACE_FILE" default:"traces.jsonl"`
+
+	// MetricsToken enables /metrics on the public listener when set, for Prometheus to scrape by sending it as a bearer
+	// token. The admin listener serves /metrics regardless.
+	MetricsToken string `envconfig:"METRICS_TOKEN"`
+
+	// ShutdownDrainDelay is how long the app keeps serving after it's told to stop, while reporting itself unready, so
+	// load balancers can stop sending it traffic before the listener closes.
+	ShutdownDrainDelay time.Duration `envconfig:"SHUTDOWN_DRAIN_DELAY" default:"0s"`
+	// ShutdownTimeout is how long in-flight requests get to finish after the drain delay, before they're cut off.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+
+	// Users log in with any of the identity providers whose key (client ID) is set, see providers.go. GitLabURL and
+	// OktaOrgURL say where the GitLab and Okta instances are. OIDCIssuerURL is any OpenID Connect provider's issuer,
+	// whose endpoints are discovered from it at startup; OIDCName names it in URLs and OIDCDisplayName on the login page.
+	GoogleOAuthKey       string `envconfig:"GOOGLE_OAUTH_KEY"`
+	GoogleOAuthSecret    string `envconfig:"GOOGLE_OAUTH_SECRET"`
+	GitHubOAuthKey       string `envconfig:"GITHUB_OAUTH_KEY"`
+	GitHubOAuthSecret    string `envconfig:"GITHUB_OAUTH_SECRET"`
+	GitLabOAuthKey       string `envconfig:"GITLAB_OAUTH_KEY"`
+	GitLabOAuthSecret    string `envconfig:"GITLAB_OAUTH_SECRET"`
+	GitLabURL            string `envconfig:"GITLAB_URL" default:"https://gitlab.com"`
+	MicrosoftOAuthKey    string `envconfig:"MICROSOFT_OAUTH_KEY"`
+	MicrosoftOAuthSecret string `envconfig:"MICROSOFT_OAUTH_SECRET"`
+	OktaOAuthKey         string `envconfig:"OKTA_OAUTH_KEY"`
+	OktaOAuthSecret      string `envconfig:"OKTA_OAUTH_SECRET"`
+	OktaOrgURL           string `envconfig:"OKTA_ORG_URL"`
+	OIDCClientID         string `envconfig:"OIDC_CLIENT_ID"`
+	OIDCClientSecret     string `envconfig:"OIDC_CLIENT_SECRET"`
+	OIDCIssuerURL        string `envconfig:"OIDC_ISSUER_URL"`
+	OIDCName             string `envconfig:"OIDC_NAME" default:"oidc"`
+	OIDCDisplayName      string `envconfig:"OIDC_DISPLAY_NAME" default:"Single sign-on"`
 }
 
 type App struct {
-	conf   Config
-	srv    *http.Server
-	render *Renderer
-	db     *models.DB
+	conf Config
+	srv  *http.Server
+	// adminSrv serves the admin endpoints if AdminAddr is set, otherwise it's nil.
+	adminSrv *http.Server
+	render   *Renderer
+	// db is nil when the app was given its stores with options rather than connecting to the database.
+	db    *models.DB
+	users models.UserStore
+	// sessionStore is where sessions are kept. sessions is the same store when they're kept in the database, and nil
+	// otherwise.
+	sessionStore sessions.Store
+	sessions     *models.SessionStore
+	// providers are the identity providers users can log in with.
+	providers []*AuthProvider
+	// listener, if set, is where Start serves rather than listening on ServerAddr.
+	listener net.Listener
+	// done is closed when the server started by Start stops, after serveErr is set to why if it failed.
+	done     chan struct{}
+	serveErr error
+	// stop is closed when Stop is called, to end background work.
+	stop     chan struct{}
+	stopOnce sync.Once
+	health   health
+	metrics  *metrics
+	logger   *slog.Logger
+	// tracerProvider is nil unless tracing is configured.
+	tracerProvider *sdktrace.TracerProvider
+}
+
+// Option customizes an App created by NewApp.
+type Option func(*App)
+
+// WithUserStore makes the app keep users in the given store rather than the database, e.g. a models.MemoryUserStore so
+// tests can run without Postgres. When every store is provided, the app doesn't connect to the database at all.
+func WithUserStore(s models.UserStore) Option {
+	return func(app *App) { app.users = s }
+}
+
+// WithListener makes Start serve on the given listener rather than listening on ServerAddr, e.g. one on an ephemeral
+// port opened by a test, or one passed down by a process manager.
+func WithListener(l net.Listener) Option {
+	return func(app *App) { app.listener = l }
+}
+
+// WithLogger makes the app write its access log to the given logger rather than slog's default one.
+func WithLogger(l *slog.Logger) Option {
+	return func(app *App) { app.logger = l }
 }
 
-func NewApp(conf Config) (*App, error) {
-	app := &App{conf: conf}
+func NewApp(conf Config, opts ...Option) (*App, error) {
+	app := &App{
+		conf:    conf,
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		metrics: newMetrics(),
+		logger:  slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(app)
+	}
+
+	// Check our session keys. For test/dev they can be a dummy but for production they must be secure.
+	keys, err := conf.sessionKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up the database, unless we've been given stores to use instead
+	if app.users == nil {
+		conf.DBConfig.CursorSecrets = keys.CursorSecrets()
+		app.db, err = models.NewDB(conf.DBConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not create database: %w", err)
+		}
+		app.users = app.db
+		app.AddReadinessCheck("database", CheckerFunc(app.db.PingContext))
+		app.metrics.registry.MustRegister(collectors.NewDBStatsCollector(app.db.DB.DB, conf.DBConfig.DBName))
+	}
 
-	// Set up the database
-	var err error
-	app.db, err = models.NewDB(conf.DBConfig)
+	// Create the built-in roles, so there's something to give users.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = app.setupRoles(ctx)
+	cancel()
 	if err != nil {
-		return nil, fmt.Errorf("could not create database: %w", err)
+		return nil, err
 	}
 
-	// Configure our session store. For test/dev it can be a dummy but for production it must be secure.
+	app.tracerProvider, err = setupTracing(context.Background(), conf)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up tracing: %w", err)
+	}
+
+	// Configure our session store
 	var sessionStore sessions.Store
-	if conf.DeployEnv.IsProduction() {
-		if conf.SessionSecret == "" {
-			return nil, fmt.Errorf("SESSION_SECRET must be set")
+	switch conf.SessionStore {
+	case "cookie", "":
+		s := sessions.NewCookieStore(keys.Pairs()...)
+		if conf.DeployEnv.IsProduction() {
+			s.Options.Secure = true
+			s.Options.HttpOnly = true
+			if keys[0].Encryption == nil {
+				app.logger.Warn("Session cookies are signed but not encrypted, add an encryption key to SESSION_KEYS")
+			}
 		}
-		s := sessions.NewCookieStore([]byte(conf.SessionSecret))
-		s.Options.Secure = true
-		s.Options.HttpOnly = true
 		sessionStore = s
-	} else {
-		if conf.SessionSecret == "" {
-			conf.SessionSecret = "not-so-super-secret"
+	case "postgres":
+		if conf.SessionCleanupInterval < 0 {
+			return nil, fmt.Errorf("SESSION_CLEANUP_INTERVAL must not be negative, got %s", conf.SessionCleanupInterval)
+		}
+		if app.db == nil {
+			return nil, fmt.Errorf("SESSION_STORE=postgres needs the database, but the app was given other stores")
 		}
-		sessionStore = sessions.NewCookieStore([]byte(conf.SessionSecret))
+		app.sessions = models.NewSessionStore(app.db, keys.Pairs()...)
+		app.sessions.Options.Secure = conf.DeployEnv.IsProduction()
+		app.sessions.OwnerKey = "UserID"
+		sessionStore = app.sessions
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q, must be cookie or postgres", conf.SessionStore)
 	}
+	app.sessionStore = sessionStore
 
-	// Set up oauth, which is configured globally here and applied in routes.go
-	gothic.Store = sessionStore
-	goth.UseProviders(
-		google.New(conf.GoogleOAuthKey, conf.GoogleOAuthSecret, conf.SiteURL+"/auth/google/callback"),
-	)
+	// Set up oauth, whose providers are kept per app and used by the auth handlers in auth.go
+	if err := conf.validateAllowlist(); err != nil {
+		return nil, err
+	}
+	app.providers, err = conf.authProviders()
+	if err != nil {
+		return nil, err
+	}
 
 	// Define our router middleware (logging, etc.), then define routes
 	router := chi.NewRouter()
-	router.Use(middleware.Logger)
 	router.Use(middleware.Recoverer)
 	router.Use(secure.New(secure.Options{
 		IsDevelopment:   !conf.DeployEnv.IsProduction(),
@@ -85,7 +238,7 @@ func NewApp(conf Config) (*App, error) {
 	corsOptions := cors.Options{
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", RequestIDHeader},
 		AllowCredentials: true, // Required for session cookies in cross-origin requests
 		MaxAge:           300,  // Maximum value not ignored by any of major browsers
 	}
@@ -110,7 +263,16 @@ func NewApp(conf Config) (*App, error) {
 	}
 	// In development, the zero-value CrossOriginProtection allows all origins
 	router.Use(func(next http.Handler) http.Handler {
-		return crossOriginProtection.Handler(next)
+		protected := crossOriginProtection.Handler(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Requests with an API token can't be forged by other sites, since browsers don't attach tokens the way
+			// they do cookies. RequireLogin authenticates them by the token alone, never falling back to the session.
+			if _, ok := bearerToken(r); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			protected.ServeHTTP(w, r)
+		})
 	})
 	router.Use(kbsession.NewMiddleware(sessionStore))
 
@@ -118,37 +280,147 @@ func NewApp(conf Config) (*App, error) {
 		return nil, fmt.Errorf("error defining routes: %w", err)
 	}
 
+	// Health probes and metrics are served ahead of most of the middleware above, since load balancers and Prometheus
+	// make them over plain HTTP without sessions, and every few seconds. Only request IDs, logging and metrics apply to
+	// every request.
+	root := chi.NewRouter()
+	root.Use(RequestID)
+	root.Use(Trace)
+	root.Use(app.AccessLog)
+	root.Use(app.metrics.Middleware)
+	root.Get("/healthz", app.HealthzGET)
+	root.Get("/readyz", app.ReadyzGET)
+	if conf.MetricsToken != "" {
+		root.Method(http.MethodGet, "/metrics", app.metrics.Handler(conf.MetricsToken))
+	}
+	root.Mount("/", router)
+
 	app.srv = &http.Server{
 		Addr:    conf.ServerAddr,
-		Handler: router,
+		Handler: root,
+	}
+	if conf.AdminAddr != "" {
+		addr, err := adminListenAddr(conf.AdminAddr)
+		if err != nil {
+			return nil, err
+		}
+		app.adminSrv = &http.Server{Addr: addr, Handler: app.adminHandler()}
 	}
 	app.render, err = NewRenderer(conf.DeployEnv.IsProduction())
 	if err != nil {
 		return nil, fmt.Errorf("could not create renderer: %w", err)
 	}
+	app.render.revocableSessions = app.sessions != nil
 
 	return app, nil
 }
 
-// Start begins listening for connections and serving clients in the background.
-func (app *App) Start() {
+// Handler returns the app's HTTP handler, with all its middleware and routes, for serving it some other way than Start,
+// e.g. with httptest.
+func (app *App) Handler() http.Handler {
+	return app.srv.Handler
+}
+
+// Start binds the listeners and begins serving clients in the background. It returns an error if it can't listen, e.g.
+// because the address is already in use. Afterwards, use Done or Wait to learn when the server stops.
+func (app *App) Start() error {
+	var adminListener net.Listener
+	if app.adminSrv != nil {
+		var err error
+		if adminListener, err = net.Listen("tcp", app.adminSrv.Addr); err != nil {
+			return fmt.Errorf("could not listen on admin address %s: %w", app.adminSrv.Addr, err)
+		}
+		// Record the actual address, in case it was given an ephemeral port.
+		app.adminSrv.Addr = adminListener.Addr().String()
+	}
+
+	l := app.listener
+	if l == nil {
+		addr := app.srv.Addr
+		if addr == "" {
+			addr = ":http"
+		}
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			if adminListener != nil {
+				adminListener.Close()
+			}
+			return fmt.Errorf("could not listen on %s: %w", addr, err)
+		}
+	}
+
+	if adminListener != nil {
+		go func() {
+			// Losing the admin endpoints isn't worth taking the app down for, so only log it.
+			if err := app.adminSrv.Serve(adminListener); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Admin server failed", "err", err)
+			}
+		}()
+		slog.Info("Admin server listening", "addr", adminListener.Addr().String())
+	}
+	if app.sessions != nil && app.conf.SessionCleanupInterval > 0 {
+		go app.cleanupSessions()
+	}
 	go func() {
-		if err := app.srv.ListenAndServe(); err != http.ErrServerClosed {
-			slog.Warn("Server encountered an unexpected error while stopping", "err", err)
+		defer close(app.done)
+		if err := app.srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			app.serveErr = err
 		}
 	}()
-	slog.Info("Server listening", "addr", app.conf.ServerAddr)
+	slog.Info("Server listening", "addr", l.Addr().String())
+	return nil
+}
+
+// Done returns a channel that's closed when a started server stops serving, either because Stop was called or because
+// it failed.
+func (app *App) Done() <-chan struct{} {
+	return app.done
 }
 
-// Stop gracefully shuts down the server and closes the database. Set a timeout on the provided context to force
-// shutdown after a certain amount of time.
+// Wait blocks until a started server stops serving, returning the error it failed with, or nil if it was stopped by
+// Stop.
+func (app *App) Wait() error {
+	<-app.done
+	return app.serveErr
+}
+
+// Stop gracefully shuts down the server and closes the database. The app reports itself unready from the moment Stop is
+// called, and keeps serving for the configured ShutdownDrainDelay before closing the listener and waiting for in-flight
+// requests to finish. Set a timeout on the provided context to cut off any still running after a certain amount of
+// time; see ShutdownTimeout.
 func (app *App) Stop(ctx context.Context) error {
+	app.setStopping()
+	app.stopOnce.Do(func() { close(app.stop) })
+
+	select {
+	case <-app.done:
+		// The server already died, there's nothing to drain.
+	case <-ctx.Done():
+	case <-time.After(app.conf.ShutdownDrainDelay):
+	}
+
 	var result error
 	if err := app.srv.Shutdown(ctx); err != nil {
 		result = multierror.Append(result, fmt.Errorf("could not shutdown server: %w", err))
+		// Forcibly close whatever connections are left, so they don't outlive the database.
+		app.srv.Close()
+	}
+	// The admin server goes last, so health and metrics can be watched while the app drains.
+	if app.adminSrv != nil {
+		if err := app.adminSrv.Shutdown(ctx); err != nil {
+			result = multierror.Append(result, fmt.Errorf("could not shutdown admin server: %w", err))
+			app.adminSrv.Close()
+		}
 	}
-	if err := app.db.Close(); err != nil {
-		result = multierror.Append(result, fmt.Errorf("could not close database: %w", err))
+	if app.db != nil {
+		if err := app.db.Close(); err != nil {
+			result = multierror.Append(result, fmt.Errorf("could not close database: %w", err))
+		}
+	}
+	if app.tracerProvider != nil {
+		if err := app.tracerProvider.Shutdown(ctx); err != nil {
+			result = multierror.Append(result, fmt.Errorf("could not flush traces: %w", err))
+		}
 	}
 	return result
 }
@@ -4,11 +4,19 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/katabole/kbexample/models"
+	"github.com/katabole/kbexample/models/dbtest"
 	"github.com/katabole/kbhttp"
 	"github.com/katabole/kbsql"
 	"github.com/kelseyhightower/envconfig"
@@ -35,38 +43,72 @@ func TestMain(m *testing.M) {
 	}
 	log.Printf("Loaded env %s", testEnv)
 
-	// Now create databases if necessary. These may already exist but especially for CI doing it here is convenient.
-	if err := kbsql.PostgresCreateDBIfNotExistsByURL(conf.DBConfig.URL()); err != nil {
-		log.Fatalf("Error creating database %s: %v", conf.DBConfig.URL(), err)
-	}
-	atlasDevDBConf := conf.DBConfig
-	atlasDevDBConf.DBName = "atlas_dev"
-	if err := kbsql.PostgresCreateDBIfNotExistsByURL(atlasDevDBConf.URL()); err != nil {
-		log.Fatalf("Error creating database %s: %v", atlasDevDBConf.URL(), err)
-	}
-	if err := kbsql.AtlasSetupDB(conf.DBConfig.URL(), atlasDevDBConf.URL()); err != nil {
-		log.Fatalf("Error setting up database: %v", err)
-	}
-
 	os.Exit(m.Run())
 }
 
+var (
+	setupDBOnce sync.Once
+	setupDBErr  error
+)
+
+// setupDB creates the test database the first time it's called, so tests using NewMemoryFixture can run without
+// Postgres. It may already exist but especially for CI doing it here is convenient.
+func setupDB() error {
+	setupDBOnce.Do(func() {
+		if err := kbsql.PostgresCreateDBIfNotExistsByURL(conf.DBConfig.URL()); err != nil {
+			setupDBErr = fmt.Errorf("could not create database %s: %w", conf.DBConfig.URL(), err)
+		}
+	})
+	return setupDBErr
+}
+
 type Fixture struct {
 	t       *testing.T
 	App     *App
 	Client  *kbhttp.Client
 	BaseURL string
+	// Users is the in-memory store behind a fixture from NewMemoryFixture, for setting up and checking data directly.
+	Users *models.MemoryUserStore
+
+	server *httptest.Server
 }
 
-// NewFixture starts a local test server and returns it along with a cleanup function that should be deferred.
+// NewFixture starts a local test server backed by a fresh schema of the test database and returns it along with a
+// cleanup function that should be deferred.
 func NewFixture(t *testing.T) *Fixture {
-	app, err := NewApp(conf)
+	require.NoError(t, setupDB())
+	c := conf
+	c.DBConfig.Schema = dbtest.NewSchema(t, conf.DBConfig.URL())
+	return newFixture(t, c)
+}
+
+// NewMemoryFixture starts a local test server with an in-memory store rather than the database, so tests using it are
+// fast and don't need Postgres.
+func NewMemoryFixture(t *testing.T) *Fixture {
+	users := models.NewMemoryUserStore()
+	f := newFixture(t, conf, WithUserStore(users))
+	f.Users = users
+	return f
+}
+
+// newFixture serves the app with httptest on an ephemeral port, so tests can run in parallel. The site URL is set to
+// the server's, as if it were the deployed site, and the server is accepting connections by the time this returns.
+func newFixture(t *testing.T, c Config, opts ...Option) *Fixture {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c.ServerAddr = l.Addr().String()
+	c.SiteURL = "http://" + c.ServerAddr
+
+	app, err := NewApp(c, opts...)
+	if err != nil {
+		l.Close()
+	}
 	require.Nil(t, err)
 
-	app.Start()
-	require.NoError(t, kbsql.PostgresCleanDB(app.db.DB))
+	server := &httptest.Server{Listener: l, Config: &http.Server{Handler: app.Handler()}}
+	server.Start()
 
-	baseURL, err := url.Parse("http://" + app.srv.Addr)
+	baseURL, err := url.Parse(server.URL)
 	require.Nil(t, err)
 
 	return &Fixture{
@@ -74,14 +116,107 @@ func NewFixture(t *testing.T) *Fixture {
 		App:     app,
 		Client:  kbhttp.NewClient(kbhttp.ClientConfig{BaseURL: baseURL}),
 		BaseURL: baseURL.String(),
+		server:  server,
 	}
 }
 
 func (f *Fixture) Cleanup() {
+	f.server.Close()
 	assert.Nil(f.t, f.App.Stop(context.Background()))
 }
 
+// Login logs the fixture's client in as the given user, as if they'd completed an OAuth login, by giving it a session
+// cookie. The client keeps cookies from then on.
+func (f *Fixture) Login(u *models.User) {
+	r := httptest.NewRequest(http.MethodGet, f.URL("/"), nil)
+	s, err := f.App.sessionStore.New(r, "RootSession")
+	require.NoError(f.t, err)
+	s.Values["UserID"] = u.ID
+	s.Values["LastUsed"] = time.Now().Unix()
+	w := httptest.NewRecorder()
+	require.NoError(f.t, s.Save(r, w))
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(f.t, err)
+	jar.SetCookies(r.URL, w.Result().Cookies())
+	client := *f.Client.Client
+	client.Jar = jar
+	f.Client.Client = &client
+}
+
 // URL returns the full URL for the given path.
 func (f *Fixture) URL(path string) string {
 	return f.BaseURL + path
 }
+
+// TestStartWithListener validates that Start serves on an injected listener.
+func TestStartWithListener(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	app, err := NewApp(conf, WithUserStore(models.NewMemoryUserStore()), WithListener(l))
+	require.NoError(t, err)
+
+	require.NoError(t, app.Start())
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, app.Stop(context.Background()))
+	assert.NoError(t, app.Wait(), "stopping the server isn't a failure")
+}
+
+// TestStartErrors validates that Start reports when it can't listen, and Wait when the server dies after starting.
+func TestStartErrors(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	c := conf
+	c.ServerAddr = l.Addr().String()
+	app, err := NewApp(c, WithUserStore(models.NewMemoryUserStore()))
+	require.NoError(t, err)
+	assert.Error(t, app.Start(), "the address is already in use")
+
+	app, err = NewApp(conf, WithUserStore(models.NewMemoryUserStore()), WithListener(l))
+	require.NoError(t, err)
+	require.NoError(t, app.Start())
+	l.Close()
+	select {
+	case <-app.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't stop after its listener closed")
+	}
+	assert.Error(t, app.Wait())
+	assert.NoError(t, app.Stop(context.Background()))
+}
+
+// TestStopDrains validates that Stop reports the app unready while it keeps serving for the drain delay.
+func TestStopDrains(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c := conf
+	c.ShutdownDrainDelay = 500 * time.Millisecond
+	app, err := NewApp(c, WithUserStore(models.NewMemoryUserStore()), WithListener(l))
+	require.NoError(t, err)
+	require.NoError(t, app.Start())
+
+	start := time.Now()
+	stopped := make(chan error)
+	go func() { stopped <- app.Stop(context.Background()) }()
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		resp, err := http.Get("http://" + l.Addr().String() + "/readyz")
+		require.NoError(c, err)
+		resp.Body.Close()
+		assert.Equal(c, http.StatusServiceUnavailable, resp.StatusCode)
+	}, c.ShutdownDrainDelay, 10*time.Millisecond)
+
+	assert.NoError(t, <-stopped)
+	assert.GreaterOrEqual(t, time.Since(start), c.ShutdownDrainDelay)
+	assert.NoError(t, app.Wait())
+}
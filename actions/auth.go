@@ -1,67 +1,260 @@
 package actions
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/katabole/kbexample/models"
 	"github.com/katabole/kbsession"
-	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth"
 )
 
 const CookieLifetime = 2 * time.Hour
 
+type currentUserKey struct{}
+
+// GetCurrentUser returns the logged in user, as loaded by LoadUser or RequireLogin, or nil if there isn't one.
+func GetCurrentUser(ctx context.Context) *models.User {
+	u, _ := ctx.Value(currentUserKey{}).(*models.User)
+	return u
+}
+
+// withCurrentUser returns the request with the given user logged in, noting them for the access log too.
+func withCurrentUser(r *http.Request, u *models.User) *http.Request {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.userEmail = u.Email
+	}
+	return r.WithContext(context.WithValue(r.Context(), currentUserKey{}, u))
+}
+
+// LoginGET handles GET /login, listing the providers users can log in with.
+func (app *App) LoginGET(w http.ResponseWriter, r *http.Request) {
+	if GetCurrentUser(r.Context()) != nil {
+		app.render.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	app.render.HTML(w, r, HTMLParams{Template: "login", Title: "Log in", Data: map[string]any{"Providers": app.providers}})
+}
+
+// AuthGET handles GET /auth?provider=<name>, sending the user to the provider to log in.
+func (app *App) AuthGET(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("provider")
+	if app.authProvider(name) == nil {
+		app.render.Error(w, r, &NotFoundError{Err: fmt.Errorf("no login provider named %q", name)})
+		return
+	}
+	authURL, err := app.beginAuth(w, r, app.authProvider(name))
+	if err != nil {
+		app.render.Error(w, r, err)
+		return
+	}
+	app.render.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
+}
+
+// authSessionName names the session that holds a login's state while the user is away at the provider.
+const authSessionName = "_gothic_session"
+
+// beginAuth starts logging in with the provider, returning the URL to send the user to, and keeps what the callback
+// needs to finish in the app's session store. This is what gothic does too, but gothic keeps its session store and
+// providers in globals, which every App in the process would share.
+func (app *App) beginAuth(w http.ResponseWriter, r *http.Request, provider *AuthProvider) (string, error) {
+	sess, err := provider.goth.BeginAuth(rand.Text())
+	if err != nil {
+		return "", fmt.Errorf("could not begin %s login: %w", provider.DisplayName, err)
+	}
+	authURL, err := sess.GetAuthURL()
+	if err != nil {
+		return "", fmt.Errorf("could not begin %s login: %w", provider.DisplayName, err)
+	}
+
+	s, _ := app.sessionStore.New(r, authSessionName)
+	s.Values[provider.Name] = sess.Marshal()
+	return authURL, s.Save(r, w)
+}
+
+// completeAuth finishes logging in with the provider once it's sent the user back to the callback, checking the state
+// matches the one beginAuth sent them off with, and returns who they are. The login's session is deleted either way,
+// so it can't be replayed.
+func (app *App) completeAuth(w http.ResponseWriter, r *http.Request, provider *AuthProvider) (goth.User, error) {
+	s, _ := app.sessionStore.Get(r, authSessionName)
+	value, ok := s.Values[provider.Name].(string)
+	if !ok {
+		return goth.User{}, fmt.Errorf("no %s login in progress", provider.DisplayName)
+	}
+	s.Options.MaxAge = -1
+	clear(s.Values)
+	if err := s.Save(r, w); err != nil {
+		return goth.User{}, err
+	}
+
+	sess, err := provider.goth.UnmarshalSession(value)
+	if err != nil {
+		return goth.User{}, err
+	}
+	authURL, err := sess.GetAuthURL()
+	if err != nil {
+		return goth.User{}, err
+	}
+	if sent, err := url.Parse(authURL); err != nil || sent.Query().Get("state") != r.URL.Query().Get("state") {
+		return goth.User{}, errors.New("state token mismatch")
+	}
+	if _, err := sess.Authorize(provider.goth, r.URL.Query()); err != nil {
+		return goth.User{}, err
+	}
+	return provider.goth.FetchUser(sess)
+}
+
+// AuthCallback handles GET /auth/{provider}/callback, where the provider sends the user back once they've logged in.
 func (app *App) AuthCallback(w http.ResponseWriter, r *http.Request) {
-	// gothic has a variety of ways it figures out the provider, and unfortunately just taking an argument isn't one of
-	// them, so we do it by setting a query parameter here.
-	v := r.URL.Query()
-	v.Set("provider", chi.URLParam(r, "provider"))
-	r.URL.RawQuery = v.Encode()
+	provider := app.authProvider(chi.URLParam(r, "provider"))
+	if provider == nil {
+		app.render.Error(w, r, &NotFoundError{Err: fmt.Errorf("no login provider named %q", chi.URLParam(r, "provider"))})
+		return
+	}
 
-	user, err := gothic.CompleteUserAuth(w, r)
+	gothUser, err := app.completeAuth(w, r, provider)
 	if err != nil {
-		app.render.JSONError(w, r, http.StatusUnauthorized, err)
+		app.render.Error(w, r, &UnauthorizedError{Err: err})
 		return
 	}
 
+	// Users are matched up by email across providers, so only take emails they're known to own.
+	login := models.Login{
+		Provider:       provider.Name,
+		ProviderUserID: gothUser.UserID,
+		Name:           gothUser.Name,
+		AvatarURL:      gothUser.AvatarURL,
+	}
+	if provider.emailVerified(gothUser) {
+		login.Email = gothUser.Email
+	}
+	if reason := app.conf.loginDenial(provider, gothUser, login.Email); reason != "" {
+		app.logger.Warn("Login rejected", "security_event", "login_rejected", "reason", reason,
+			"provider", provider.Name, "provider_user_id", gothUser.UserID, "email", gothUser.Email,
+			"remote_addr", r.RemoteAddr, "request_id", GetRequestID(r.Context()))
+		// The user's come back from the provider in their browser, so show them a page whatever they accept.
+		app.render.HTML(w, r, HTMLParams{
+			Status:   http.StatusForbidden,
+			Template: "login_denied",
+			Title:    "Login not allowed",
+			Data:     map[string]any{"Email": gothUser.Email, "Provider": provider.DisplayName},
+		})
+		return
+	}
+	user, err := app.users.LoginUser(r.Context(), login)
+	if err != nil {
+		if errors.Is(err, models.ErrUserDisabled) {
+			err = &ForbiddenError{Err: err}
+		}
+		app.render.Error(w, r, err)
+		return
+	}
+	if err := app.bootstrapAdmin(r.Context(), user); err != nil {
+		app.render.Error(w, r, err)
+		return
+	}
+	r = withCurrentUser(r, user)
+
 	s := kbsession.Get(r)
-	s.Values["UserName"] = user.Name
-	s.Values["UserEmail"] = user.Email
+	if app.sessions != nil {
+		if err := app.sessions.Renew(r.Context(), s); err != nil {
+			app.render.Error(w, r, err)
+			return
+		}
+	}
+	s.Values["UserID"] = user.ID
 	s.Values["LastUsed"] = time.Now().Unix()
+	app.metrics.logins.Inc()
 	app.render.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// RequireLogin checks whether or not a user is logged in with an unexpired session cookie
-// if the user is not logged in, then the frontend should redirect to /auth/google
-func (app *App) RequireLogin(next http.Handler) http.Handler {
+// LoadUser is middleware, run inside the session middleware, that loads the logged in user and their permissions into
+// the request context (see GetCurrentUser and GetPermissions). Sessions unused for longer than CookieLifetime are
+// logged out, as are users who've been disabled or deleted since they logged in, or who the allowlist no longer lets
+// in.
+func (app *App) LoadUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s := kbsession.Get(r)
-		lastUsed := s.Values["LastUsed"]
-
-		if lastUsed != nil {
-			lastUsedEpoch := time.Unix(lastUsed.(int64), 0)
-			if time.Since(lastUsedEpoch) > CookieLifetime {
+		if lastUsed, ok := s.Values["LastUsed"].(int64); ok {
+			if time.Since(time.Unix(lastUsed, 0)) > CookieLifetime {
 				clear(s.Values)
 			} else {
 				s.Values["LastUsed"] = time.Now().Unix()
 			}
 		}
 
-		if s.Values["UserEmail"] == nil {
+		id, ok := s.Values["UserID"].(int)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := app.users.GetUserByID(r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && (user.Disabled || app.conf.userDenial(user) != "")) {
+			clear(s.Values)
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			app.render.Error(w, r, err)
+			return
+		}
+		permissions, err := app.userPermissions(r.Context(), user)
+		if err != nil {
+			app.render.Error(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, withPermissions(withCurrentUser(r, user), permissions))
+	})
+}
+
+// RequireLogin is middleware, run after LoadUser, that checks whether or not a user is logged in. If the user is not
+// logged in, they're redirected to the login page. Scripts can log in with an "Authorization: Bearer <token>" header
+// instead, giving an API token, in which case the session is ignored.
+func (app *App) RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secret, ok := bearerToken(r); ok {
+			tr, err := app.withAPIToken(r, secret)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				app.render.Error(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, tr)
+			return
+		}
+
+		if GetCurrentUser(r.Context()) == nil {
 			if app.conf.DeployEnv.IsProduction() || app.conf.EnforceAuth {
-				app.render.Redirect(w, r, "/auth?provider=google", http.StatusSeeOther)
+				app.render.Redirect(w, r, "/login", http.StatusSeeOther)
 				return
 			}
 
-			// In dev/test, just use a test user.
-			s.Values["UserName"] = "Joe Schmoe"
-			s.Values["UserEmail"] = "joe.schmoe@example.com"
+			// In dev/test, just use a test user. They aren't in the database, so have no ID, and may do anything.
+			user := &models.User{Name: "Joe Schmoe", Email: "joe.schmoe@example.com"}
+			permissions, err := app.userPermissions(r.Context(), user)
+			if err != nil {
+				app.render.Error(w, r, err)
+				return
+			}
+			r = withPermissions(withCurrentUser(r, user), permissions)
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
 func (app *App) LogoutGET(w http.ResponseWriter, r *http.Request) {
-	clear(kbsession.Get(r).Values)
+	s := kbsession.Get(r)
+	if GetCurrentUser(r.Context()) != nil {
+		app.metrics.logouts.Inc()
+	}
+	clear(s.Values)
+	// Delete the session outright, which for server-side sessions revokes it.
+	s.Options.MaxAge = -1
 	app.render.Redirect(w, r, "/", http.StatusSeeOther)
 }
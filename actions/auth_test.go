@@ -0,0 +1,53 @@
+package actions
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoadUser validates that a logged in user is loaded from their session, and logged out once they're disabled or
+// deleted.
+func TestLoadUser(t *testing.T) {
+	t.Parallel()
+	users := models.NewMemoryUserStore()
+	c := conf
+	c.EnforceAuth = true
+	f := newFixture(t, c, WithUserStore(users))
+	defer f.Cleanup()
+	f.Client.Client = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// getUsers fetches the user listing, returning where it redirected to if it did.
+	getUsers := func() string {
+		req, err := http.NewRequest(http.MethodGet, "/users", nil)
+		require.NoError(t, err)
+		resp, err := f.Client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.Header.Get("Location")
+	}
+	assert.Equal(t, "/login", getUsers(), "not logged in")
+
+	u, err := users.LoginUser(t.Context(), models.Login{Provider: "google", ProviderUserID: "1", Email: "tim@example.com", Name: "Tim Smith"})
+	require.NoError(t, err)
+	f.Login(u)
+	assert.Empty(t, getUsers())
+	page, err := f.Client.GetPage("/")
+	require.NoError(t, err)
+	assert.Contains(t, page, "Tim Smith", "the layout shows who's logged in")
+
+	u.Disabled = true
+	require.NoError(t, users.UpdateUser(t.Context(), u))
+	assert.Equal(t, "/login", getUsers(), "disabled users are logged out")
+	u.Disabled = false
+	require.NoError(t, users.UpdateUser(t.Context(), u))
+	assert.Equal(t, "/login", getUsers(), "and stay logged out")
+
+	f.Login(u)
+	assert.Empty(t, getUsers())
+	require.NoError(t, users.DeleteUser(t.Context(), u.ID))
+	assert.Equal(t, "/login", getUsers(), "deleted users are logged out")
+}
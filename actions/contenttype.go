@@ -1,8 +1,11 @@
 package actions
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"reflect"
+	"strings"
 
 	// If Go adds accept header negotiation to the standard library we may want to use it, see
 	// https://github.com/golang/go/issues/19307
@@ -12,20 +15,48 @@ import (
 type ContentType int
 
 const (
-	ContentTypeHTML = iota
+	ContentTypeHTML ContentType = iota
 	ContentTypeJSON
+	ContentTypeCSV
+	ContentTypeXML
+	ContentTypeNDJSON
+	ContentTypeMsgPack
 )
 
-var (
-	mediaTypeHTML contenttype.MediaType = contenttype.NewMediaType("text/html")
-	mediaTypeJSON                       = contenttype.NewMediaType("application/json")
+// supportedMediaTypes lists the media types we understand and which ContentType each maps to. Some formats go by more
+// than one name, the first listed for each is the one we respond with (see encoders in encoding.go).
+//
+// NOTE: the first in this list will be used as the default when negotiating Accept headers below.
+var supportedMediaTypes = []struct {
+	mediaType   contenttype.MediaType
+	contentType ContentType
+}{
+	{contenttype.NewMediaType("text/html"), ContentTypeHTML},
+	{contenttype.NewMediaType("application/json"), ContentTypeJSON},
+	{contenttype.NewMediaType("text/csv"), ContentTypeCSV},
+	{contenttype.NewMediaType("application/xml"), ContentTypeXML},
+	{contenttype.NewMediaType("text/xml"), ContentTypeXML},
+	{contenttype.NewMediaType("application/x-ndjson"), ContentTypeNDJSON},
+	{contenttype.NewMediaType("application/ndjson"), ContentTypeNDJSON},
+	{contenttype.NewMediaType("application/msgpack"), ContentTypeMsgPack},
+	{contenttype.NewMediaType("application/x-msgpack"), ContentTypeMsgPack},
+	{contenttype.NewMediaType("application/vnd.msgpack"), ContentTypeMsgPack},
+}
 
-	// NOTE: the first in this list will be used as the default when negotiating Accept headers below.
-	availableMediaTypes []contenttype.MediaType = []contenttype.MediaType{mediaTypeHTML, mediaTypeJSON}
-)
+var availableMediaTypes = func() []contenttype.MediaType {
+	mts := make([]contenttype.MediaType, len(supportedMediaTypes))
+	for i, smt := range supportedMediaTypes {
+		mts[i] = smt.mediaType
+	}
+	return mts
+}()
+
+// ErrNotAcceptable is returned by NegotiateContentType when the client accepts none of the content types we support.
+var ErrNotAcceptable = errors.New("none of the requested content types are supported")
 
 // GetContentType figures out which of the above supported content/media types we should use with our request, by
-// checking first the "Content-Type" header, or falling back to the "Accept" header. Use it like so:
+// checking first the "Content-Type" header, or falling back to the "Accept" header. If neither gives an answer it
+// defaults to HTML. Use it like so:
 //
 //	switch GetContentType(r) {
 //	case ContentTypeHTML:
@@ -34,29 +65,52 @@ var (
 //		// Render JSON
 //	}
 func GetContentType(r *http.Request) ContentType {
+	ct, err := NegotiateContentType(r)
+	if err != nil {
+		return ContentTypeHTML
+	}
+	return ct
+}
+
+// NegotiateContentType is like GetContentType, but returns ErrNotAcceptable when the Accept header rules out every
+// type we support instead of defaulting to HTML.
+func NegotiateContentType(r *http.Request) (ContentType, error) {
 	mediaType, err := contenttype.GetMediaType(r)
 	if err == nil && !reflect.ValueOf(mediaType).IsZero() {
-		for _, mt := range availableMediaTypes {
-			if mt.Type == mediaType.Type && mt.Subtype == mediaType.Subtype {
-				return mediaTypeToContentType(mt)
-			}
+		if ct, ok := mediaTypeToContentType(mediaType); ok {
+			return ct, nil
 		}
 	}
-	// We got an error or there is not content-type header. Try using Accept instead.
+	// We got an error or there is not a supported content-type header. Try using Accept instead.
 
 	accepted, _, err := contenttype.GetAcceptableMediaType(r, availableMediaTypes)
-	if err != nil {
-		// No accept header either, just go with default
-		return ContentTypeHTML
+	if errors.Is(err, contenttype.ErrNoAcceptableTypeFound) {
+		return ContentTypeHTML, fmt.Errorf("%w: %s", ErrNotAcceptable, r.Header.Get("Accept"))
+	} else if err != nil {
+		// No usable accept header either, just go with default
+		return ContentTypeHTML, nil
 	}
-	return mediaTypeToContentType(accepted)
+	ct, _ := mediaTypeToContentType(accepted)
+	return ct, nil
 }
 
-func mediaTypeToContentType(mt contenttype.MediaType) ContentType {
-	if mt.Type == mediaTypeHTML.Type && mt.Subtype == mediaTypeHTML.Subtype {
-		return ContentTypeHTML
-	} else if mt.Type == mediaTypeJSON.Type && mt.Subtype == mediaTypeJSON.Subtype {
-		return ContentTypeJSON
+// RequireAcceptable is middleware responding 406 Not Acceptable when a client accepts none of our content types.
+func (app *App) RequireAcceptable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := NegotiateContentType(r); err != nil {
+			// The client won't take anything we offer, so explain in the format most clients can read.
+			app.render.JSONError(w, r, &NotAcceptableError{Err: err})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func mediaTypeToContentType(mt contenttype.MediaType) (ContentType, bool) {
+	for _, smt := range supportedMediaTypes {
+		if strings.EqualFold(mt.Type, smt.mediaType.Type) && strings.EqualFold(mt.Subtype, smt.mediaType.Subtype) {
+			return smt.contentType, true
+		}
 	}
-	panic("unknown media type: " + mt.String())
+	return ContentTypeHTML, false
 }
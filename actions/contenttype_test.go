@@ -0,0 +1,50 @@
+package actions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		accept      string
+		want        ContentType
+		wantErr     error
+	}{
+		{"", "", ContentTypeHTML, nil},
+		{"", "text/html,application/xhtml+xml,*/*;q=0.8", ContentTypeHTML, nil},
+		{"", "application/json", ContentTypeJSON, nil},
+		{"application/json", "text/csv", ContentTypeJSON, nil},
+		{"application/x-www-form-urlencoded", "text/csv", ContentTypeCSV, nil},
+		{"", "text/xml", ContentTypeXML, nil},
+		{"", "application/xml;q=0.5, application/x-ndjson", ContentTypeNDJSON, nil},
+		{"", "application/vnd.msgpack", ContentTypeMsgPack, nil},
+		{"", "application/pdf", ContentTypeHTML, ErrNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType+" "+tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			ct, err := NegotiateContentType(r)
+			assert.Equal(t, tt.want, ct)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "expected %v, got %v", tt.wantErr, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, GetContentType(r))
+		})
+	}
+}
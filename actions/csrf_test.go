@@ -10,6 +10,7 @@ import (
 )
 
 func TestCSRFProtection_BlocksUntrustedOrigins(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -34,6 +35,7 @@ func TestCSRFProtection_BlocksUntrustedOrigins(t *testing.T) {
 }
 
 func TestCSRFProtection_AllowsTrustedOrigins(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -42,7 +44,7 @@ func TestCSRFProtection_AllowsTrustedOrigins(t *testing.T) {
 	req, err := http.NewRequest("POST", f.URL("/users"), body)
 	require.NoError(t, err)
 
-	req.Header.Set("Origin", conf.SiteURL)
+	req.Header.Set("Origin", f.App.conf.SiteURL)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := f.Client.Do(req)
@@ -55,6 +57,7 @@ func TestCSRFProtection_AllowsTrustedOrigins(t *testing.T) {
 }
 
 func TestCSRFProtection_AllowsRefererHeader(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -63,7 +66,7 @@ func TestCSRFProtection_AllowsRefererHeader(t *testing.T) {
 	req, err := http.NewRequest("POST", f.URL("/users"), body)
 	require.NoError(t, err)
 
-	req.Header.Set("Referer", conf.SiteURL+"/users/new")
+	req.Header.Set("Referer", f.App.conf.SiteURL+"/users/new")
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := f.Client.Do(req)
@@ -75,6 +78,7 @@ func TestCSRFProtection_AllowsRefererHeader(t *testing.T) {
 }
 
 func TestCSRFProtection_BlocksInvalidReferer(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -97,6 +101,7 @@ func TestCSRFProtection_BlocksInvalidReferer(t *testing.T) {
 }
 
 func TestCSRFProtection_AllowsSafeMethodsWithoutOrigin(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -120,6 +125,7 @@ func TestCSRFProtection_AllowsSafeMethodsWithoutOrigin(t *testing.T) {
 }
 
 func TestCSRFProtection_ProtectsAllMutatingEndpoints(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -158,6 +164,7 @@ func TestCSRFProtection_ProtectsAllMutatingEndpoints(t *testing.T) {
 }
 
 func TestCSRFProtection_AllowsSameOriginRequests(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -179,6 +186,7 @@ func TestCSRFProtection_AllowsSameOriginRequests(t *testing.T) {
 }
 
 func TestCSRFProtection_BlocksMissingOriginAndReferer(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
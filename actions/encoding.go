@@ -0,0 +1,221 @@
+package actions
+
+import (
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoder writes values in one of the data formats we can respond with.
+type Encoder interface {
+	// MediaType is the Content-Type header sent with the encoded data.
+	MediaType() string
+	Encode(w io.Writer, v any) error
+}
+
+// encoders holds the Encoder for each content type other than HTML, which is rendered from templates instead.
+var encoders = map[ContentType]Encoder{
+	ContentTypeJSON:    jsonEncoder{},
+	ContentTypeCSV:     csvEncoder{},
+	ContentTypeXML:     xmlEncoder{},
+	ContentTypeNDJSON:  ndjsonEncoder{},
+	ContentTypeMsgPack: msgpackEncoder{},
+}
+
+// Collection is implemented by response envelopes around a list, e.g. a page of users with its cursors. Row-oriented
+// formats like CSV and NDJSON encode just the items, while the others encode the whole envelope.
+type Collection interface {
+	Items() any
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) MediaType() string { return "application/json; charset=UTF-8" }
+
+func (jsonEncoder) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+type xmlEncoder struct{}
+
+func (xmlEncoder) MediaType() string { return "application/xml; charset=UTF-8" }
+
+func (xmlEncoder) Encode(w io.Writer, v any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) MediaType() string { return "application/msgpack" }
+
+func (msgpackEncoder) Encode(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	// Share field names with JSON rather than tagging every type twice.
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// ndjsonEncoder writes newline-delimited JSON, one line per item for a slice or Collection.
+type ndjsonEncoder struct{}
+
+func (ndjsonEncoder) MediaType() string { return "application/x-ndjson" }
+
+func (ndjsonEncoder) Encode(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	if c, ok := v.(Collection); ok {
+		v = c.Items()
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return enc.Encode(v)
+	}
+	for i := range rv.Len() {
+		if err := enc.Encode(rv.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvEncoder writes a struct, or a slice of structs or a Collection of them, as a CSV table with a header row. Columns
+// are named by each field's "csv" tag, falling back to its "json" tag and then its name, and skipped if named "-".
+type csvEncoder struct{}
+
+func (csvEncoder) MediaType() string { return "text/csv; charset=UTF-8" }
+
+func (csvEncoder) Encode(w io.Writer, v any) error {
+	if c, ok := v.(Collection); ok {
+		v = c.Items()
+	}
+
+	rv := reflect.ValueOf(v)
+	var rows []reflect.Value
+	rowType := rv.Type()
+	if rv.Kind() == reflect.Slice {
+		rowType = rowType.Elem()
+		for i := range rv.Len() {
+			rows = append(rows, rv.Index(i))
+		}
+	} else {
+		rows = []reflect.Value{rv}
+	}
+	if rowType.Kind() == reflect.Pointer {
+		rowType = rowType.Elem()
+	}
+	if rowType.Kind() != reflect.Struct {
+		return fmt.Errorf("cannot encode %s as CSV", rv.Type())
+	}
+
+	cw := newCSVWriter(w, rowType)
+	if err := cw.WriteHeader(); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := cw.Write(row.Interface()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvWriter writes structs of a given type as CSV rows, following the column naming rules of csvEncoder.
+type csvWriter struct {
+	*csv.Writer
+	columns []csvColumn
+}
+
+type csvColumn struct {
+	name  string
+	index []int
+}
+
+// newCSVWriter returns a writer for rows of the given struct type.
+func newCSVWriter(w io.Writer, rowType reflect.Type) *csvWriter {
+	cw := &csvWriter{Writer: csv.NewWriter(w)}
+	for _, f := range reflect.VisibleFields(rowType) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("csv"); ok {
+			name = tag
+		} else if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag != "" {
+			name = tag
+		}
+		if name != "-" {
+			cw.columns = append(cw.columns, csvColumn{name: name, index: f.Index})
+		}
+	}
+	return cw
+}
+
+// Columns returns the column names, in order.
+func (cw *csvWriter) Columns() []string {
+	names := make([]string, len(cw.columns))
+	for i, col := range cw.columns {
+		names[i] = col.name
+	}
+	return names
+}
+
+// WriteHeader writes the header row of column names.
+func (cw *csvWriter) WriteHeader() error {
+	return cw.Writer.Write(cw.Columns())
+}
+
+// Write writes a row for the given struct (or pointer to one), where a nil pointer is skipped.
+func (cw *csvWriter) Write(row any) error {
+	rv := reflect.ValueOf(row)
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	record := make([]string, len(cw.columns))
+	for i, col := range cw.columns {
+		f, err := rv.FieldByIndexErr(col.index)
+		if err != nil {
+			// A nil embedded pointer, leave the field blank.
+			continue
+		}
+		record[i] = formatCSVField(f)
+	}
+	return cw.Writer.Write(record)
+}
+
+func formatCSVField(f reflect.Value) string {
+	if f.Kind() == reflect.Pointer {
+		if f.IsNil() {
+			return ""
+		}
+		f = f.Elem()
+	}
+	switch v := f.Interface().(type) {
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	case encoding.TextMarshaler:
+		text, err := v.MarshalText()
+		if err != nil {
+			return ""
+		}
+		return string(text)
+	}
+	return fmt.Sprint(f.Interface())
+}
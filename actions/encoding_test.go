@@ -0,0 +1,69 @@
+package actions
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestEncoders(t *testing.T) {
+	created := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	page := &usersResponse{
+		Users: []*models.User{
+			{ID: 1, Name: "Tim", Email: "tim@example.com", CreatedAt: created, UpdatedAt: created, LastLoginAt: &created},
+			{ID: 2, Name: "Smith, Tom", Disabled: true, CreatedAt: created, UpdatedAt: created},
+		},
+		NextCursor: "abc",
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, encoders[ContentTypeCSV].Encode(&buf, page))
+	assert.Equal(t, "id,name,email,avatar_url,disabled,created_at,updated_at,last_login_at\n"+
+		"1,Tim,tim@example.com,,false,2024-05-06T07:08:09Z,2024-05-06T07:08:09Z,2024-05-06T07:08:09Z\n"+
+		"2,\"Smith, Tom\",,,true,2024-05-06T07:08:09Z,2024-05-06T07:08:09Z,\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, encoders[ContentTypeNDJSON].Encode(&buf, page))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, `{"id":1,"name":"Tim","email":"tim@example.com","avatar_url":"","disabled":false,`+
+		`"created_at":"2024-05-06T07:08:09Z","updated_at":"2024-05-06T07:08:09Z","last_login_at":"2024-05-06T07:08:09Z"}`, lines[0])
+
+	buf.Reset()
+	require.NoError(t, encoders[ContentTypeXML].Encode(&buf, page))
+	assert.Contains(t, buf.String(), `<users next_cursor="abc"><user><id>1</id><name>Tim</name><email>tim@example.com</email>`)
+	assert.Contains(t, buf.String(), `<user><id>2</id><name>Smith, Tom</name><email></email><avatar_url></avatar_url>`+
+		`<disabled>true</disabled><created_at>2024-05-06T07:08:09Z</created_at><updated_at>2024-05-06T07:08:09Z</updated_at></user></users>`)
+
+	buf.Reset()
+	require.NoError(t, encoders[ContentTypeMsgPack].Encode(&buf, page))
+	var decoded map[string]any
+	require.NoError(t, msgpack.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, "abc", decoded["next_cursor"])
+	assert.Len(t, decoded["users"], 2)
+}
+
+func TestCSVEncoderFields(t *testing.T) {
+	type row struct {
+		Name    string     `json:"name"`
+		Secret  string     `json:"-"`
+		Renamed int        `csv:"count" json:"n"`
+		When    time.Time  `json:"when"`
+		Maybe   *time.Time `json:"maybe,omitempty"`
+		Plain   bool
+	}
+
+	var buf bytes.Buffer
+	when := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	require.NoError(t, encoders[ContentTypeCSV].Encode(&buf, row{Name: "x", Secret: "s", Renamed: 3, When: when, Plain: true}))
+	assert.Equal(t, "name,count,when,maybe,Plain\nx,3,2024-05-06T07:08:09Z,,true\n", buf.String())
+
+	buf.Reset()
+	require.Error(t, encoders[ContentTypeCSV].Encode(&buf, []string{"a"}))
+}
@@ -0,0 +1,66 @@
+package actions
+
+import (
+	"net/http"
+
+	"github.com/katabole/kbexample/models"
+)
+
+// The errors below let handlers describe what went wrong, leaving Renderer.Error to decide the response status and
+// how much to tell the client. They're all the client's fault, so their messages are safe to show even in production.
+// Any other error is treated as an internal error whose details are hidden in production.
+
+// StatusCoder is implemented by errors that carry the HTTP status they should be rendered with.
+type StatusCoder interface {
+	error
+	StatusCode() int
+}
+
+// BadRequestError means the request couldn't be understood, e.g. malformed JSON or an invalid query parameter.
+type BadRequestError struct{ Err error }
+
+func (e *BadRequestError) Error() string   { return e.Err.Error() }
+func (e *BadRequestError) Unwrap() error   { return e.Err }
+func (e *BadRequestError) StatusCode() int { return http.StatusBadRequest }
+
+// UnauthorizedError means the client isn't logged in, or failed to.
+type UnauthorizedError struct{ Err error }
+
+func (e *UnauthorizedError) Error() string   { return e.Err.Error() }
+func (e *UnauthorizedError) Unwrap() error   { return e.Err }
+func (e *UnauthorizedError) StatusCode() int { return http.StatusUnauthorized }
+
+// ForbiddenError means the client is logged in but isn't allowed to do what it asked.
+type ForbiddenError struct{ Err error }
+
+func (e *ForbiddenError) Error() string   { return e.Err.Error() }
+func (e *ForbiddenError) Unwrap() error   { return e.Err }
+func (e *ForbiddenError) StatusCode() int { return http.StatusForbidden }
+
+// NotFoundError means the requested page or resource doesn't exist.
+type NotFoundError struct{ Err error }
+
+func (e *NotFoundError) Error() string   { return e.Err.Error() }
+func (e *NotFoundError) Unwrap() error   { return e.Err }
+func (e *NotFoundError) StatusCode() int { return http.StatusNotFound }
+
+// NotAcceptableError means the client accepts none of the content types we can respond with.
+type NotAcceptableError struct{ Err error }
+
+func (e *NotAcceptableError) Error() string   { return e.Err.Error() }
+func (e *NotAcceptableError) Unwrap() error   { return e.Err }
+func (e *NotAcceptableError) StatusCode() int { return http.StatusNotAcceptable }
+
+// ConflictError means the request conflicts with the current state of a resource, e.g. a duplicate unique field.
+type ConflictError struct{ Err error }
+
+func (e *ConflictError) Error() string   { return e.Err.Error() }
+func (e *ConflictError) Unwrap() error   { return e.Err }
+func (e *ConflictError) StatusCode() int { return http.StatusConflict }
+
+// ValidationError means the request was well-formed but some of its fields were invalid.
+type ValidationError struct{ Fields models.ValidationErrors }
+
+func (e *ValidationError) Error() string   { return e.Fields.Error() }
+func (e *ValidationError) Unwrap() error   { return e.Fields }
+func (e *ValidationError) StatusCode() int { return http.StatusUnprocessableEntity }
@@ -0,0 +1,123 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds how long each readiness check may take before it's considered failed.
+const readinessTimeout = 2 * time.Second
+
+// Checker checks whether a dependency the app needs to serve requests (the database, a cache, etc.) is available,
+// returning an error describing the problem if not.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to a Checker, e.g. CheckerFunc(db.PingContext).
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error { return f(ctx) }
+
+// health holds the readiness checks and whether the app is shutting down.
+type health struct {
+	mu       sync.RWMutex
+	checks   map[string]Checker
+	stopping bool
+}
+
+// AddReadinessCheck registers a check /readyz runs under the given name, replacing any previous check with that name.
+// The app is ready only when every check passes.
+func (app *App) AddReadinessCheck(name string, c Checker) {
+	app.health.mu.Lock()
+	defer app.health.mu.Unlock()
+	if app.health.checks == nil {
+		app.health.checks = map[string]Checker{}
+	}
+	app.health.checks[name] = c
+}
+
+// setStopping marks the app as shutting down, so it reports itself unready and load balancers send traffic elsewhere.
+func (app *App) setStopping() {
+	app.health.mu.Lock()
+	defer app.health.mu.Unlock()
+	app.health.stopping = true
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthzGET handles GET /healthz, the liveness probe. It only shows the process is up and serving HTTP, so it doesn't
+// check dependencies: restarting the app won't fix a database outage.
+func (app *App) HealthzGET(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// ReadyzGET handles GET /readyz, the readiness probe. It runs every readiness check concurrently and responds 503 if any
+// fail, or if the app is shutting down, with the result of each check.
+func (app *App) ReadyzGET(w http.ResponseWriter, r *http.Request) {
+	app.health.mu.RLock()
+	stopping := app.health.stopping
+	checks := make(map[string]Checker, len(app.health.checks))
+	for name, c := range app.health.checks {
+		checks[name] = c
+	}
+	app.health.mu.RUnlock()
+
+	if stopping {
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "stopping"})
+		return
+	}
+
+	resp := healthResponse{Status: "ok", Checks: make(map[string]checkResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, c := range checks {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+			result := checkResult{Status: "ok"}
+			if err := c.Check(ctx); err != nil {
+				slog.Warn("Readiness check failed", "check", name, "err", err)
+				result.Status = "fail"
+				// Like internal errors, the details may reveal too much about our infrastructure.
+				if !app.conf.DeployEnv.IsProduction() {
+					result.Error = err.Error()
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[name] = result
+			if result.Status != "ok" {
+				resp.Status = "fail"
+			}
+		})
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+// writeHealth writes a health response directly rather than through the Renderer, since these routes are served
+// outside the session middleware.
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,69 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, f *Fixture, path string) (int, healthResponse) {
+	resp, err := http.Get(f.URL(path))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body healthResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp.StatusCode, body
+}
+
+// TestHealthz validates the liveness probe.
+func TestHealthz(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	status, body := getHealth(t, f, "/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body.Status)
+}
+
+// TestReadyz validates the readiness probe reports each check, and fails if any check does or the app is stopping.
+func TestReadyz(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	f.App.AddReadinessCheck("cache", CheckerFunc(func(ctx context.Context) error { return nil }))
+	status, body := getHealth(t, f, "/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, healthResponse{Status: "ok", Checks: map[string]checkResult{"cache": {Status: "ok"}}}, body)
+
+	f.App.AddReadinessCheck("queue", CheckerFunc(func(ctx context.Context) error { return errors.New("unreachable") }))
+	status, body = getHealth(t, f, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "fail", body.Status)
+	assert.Equal(t, checkResult{Status: "ok"}, body.Checks["cache"])
+	assert.Equal(t, checkResult{Status: "fail", Error: "unreachable"}, body.Checks["queue"])
+
+	// The fixture serves the app itself, so it keeps answering after Stop.
+	require.NoError(t, f.App.Stop(context.Background()))
+	status, body = getHealth(t, f, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "stopping", body.Status)
+}
+
+// TestReadyzDatabase validates the database is checked when the app uses it.
+func TestReadyzDatabase(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	status, body := getHealth(t, f, "/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, checkResult{Status: "ok"}, body.Checks["database"])
+}
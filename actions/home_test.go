@@ -8,7 +8,8 @@ import (
 )
 
 func TestHomeGET(t *testing.T) {
-	f := NewFixture(t)
+	t.Parallel()
+	f := NewMemoryFixture(t)
 	defer f.Cleanup()
 
 	page, err := f.Client.GetPage("/")
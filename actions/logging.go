@@ -0,0 +1,120 @@
+package actions
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestIDHeader carries a request's ID, which is taken from the request if the client (or a proxy in front of us)
+// sent one, and otherwise generated. Either way it's sent back in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the length of a request ID we'll accept from a client, as it ends up in every log line.
+const maxRequestIDLength = 128
+
+// NewLogger returns a logger writing to w in the given format, "json" or "text", at the given minimum level.
+func NewLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be json or text", format)
+	}
+}
+
+type requestIDKey struct{}
+
+// GetRequestID returns the ID of the request with the given context, or "" if it has none.
+func GetRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestID is middleware that gives every request an ID (see RequestIDHeader) and adds it to the request context.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = rand.Text()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether a client's request ID is safe to use: not too long, and only printable ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := range len(id) {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accessLogEntry collects details for the access log from deeper in the middleware stack, e.g. the logged in user,
+// see withCurrentUser.
+type accessLogEntry struct {
+	userEmail string
+}
+
+type accessLogKey struct{}
+
+// AccessLog is middleware that logs every request once it's handled, with its route pattern rather than just its path
+// so that logs group well. Health probes are logged at debug level so they don't drown out everything else.
+func (app *App) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		// Log from a defer so that requests cut short by a panic are logged too.
+		defer func() {
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+				level = slog.LevelDebug
+			}
+			app.logger.LogAttrs(r.Context(), level, "Request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("route", routePattern(r)),
+				slog.Int("status", status),
+				slog.Int("bytes", ww.BytesWritten()),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("user", entry.userEmail),
+				slog.String("request_id", GetRequestID(r.Context())),
+			)
+		}()
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+	})
+}
+
+// routePattern returns the chi route pattern the request matched, e.g. /users/{id}, or "none" if it matched no route.
+// Call it after the request has been routed.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		// A pattern of just the wildcard is the catch-all NotFound handler.
+		if p := rctx.RoutePattern(); p != "" && p != "/*" {
+			return p
+		}
+	}
+	return "none"
+}
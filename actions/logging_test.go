@@ -0,0 +1,83 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from the server's goroutines while a test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestAccessLog validates that requests are logged with their route, status, user and request ID, and that the ID is
+// taken from the request or generated, and sent back both as a header and in error responses.
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	var logs syncBuffer
+	logger, err := NewLogger(&logs, "json", slog.LevelInfo)
+	require.NoError(t, err)
+	f := newFixture(t, conf, WithUserStore(models.NewMemoryUserStore()), WithLogger(logger))
+	defer f.Cleanup()
+
+	req, err := http.NewRequest(http.MethodGet, f.URL("/users/42"), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(RequestIDHeader, "abc-123")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "abc-123", resp.Header.Get(RequestIDHeader))
+	var problem Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	assert.Equal(t, "abc-123", problem.RequestID)
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(logs.String())), &entry))
+	assert.Equal(t, "Request", entry["msg"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/users/{id}", entry["route"])
+	assert.Equal(t, float64(http.StatusNotFound), entry["status"])
+	assert.Equal(t, "joe.schmoe@example.com", entry["user"])
+	assert.Equal(t, "abc-123", entry["request_id"])
+
+	// Health probes are only logged at debug level.
+	resp, err = http.Get(f.URL("/healthz"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, strings.Count(logs.String(), "\n"))
+
+	// An ID with characters we don't want in logs is replaced.
+	req, err = http.NewRequest(http.MethodGet, f.URL("/"), nil)
+	require.NoError(t, err)
+	req.Header.Set(RequestIDHeader, "bad id")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	id := resp.Header.Get(RequestIDHeader)
+	assert.NotEmpty(t, id)
+	assert.NotEqual(t, "bad id", id)
+}
@@ -0,0 +1,61 @@
+package actions
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetrics validates that /metrics requires its token and reports requests by route pattern.
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	c := conf
+	c.MetricsToken = "secret"
+	f := newFixture(t, c, WithUserStore(models.NewMemoryUserStore()))
+	defer f.Cleanup()
+
+	var u models.User
+	require.NoError(t, f.Client.PostJSON("/users", models.User{Name: "Tim"}, &u))
+	require.NoError(t, f.Client.GetJSON("/users/1", &u))
+	resp, err := http.Get(f.URL("/no/such/page"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(f.URL("/metrics"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, f.URL("/metrics"), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `http_requests_total{method="POST",route="/users",status="201"} 1`)
+	assert.Contains(t, string(body), `http_requests_total{method="GET",route="/users/{id}",status="200"} 1`)
+	assert.Contains(t, string(body), `http_requests_total{method="GET",route="none",status="404"} 1`)
+	assert.Contains(t, string(body), `http_request_duration_seconds_bucket{method="GET",route="/users/{id}",status="200",le="+Inf"} 1`)
+	assert.Contains(t, string(body), "go_build_info")
+	assert.Contains(t, string(body), "session_logins_total 0")
+}
+
+// TestMetricsDisabled validates that /metrics isn't served publicly without a token configured.
+func TestMetricsDisabled(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	resp, err := http.Get(f.URL("/metrics"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,30 @@
+package actions
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// pageURL returns the URL of the current request with its cursor replaced, or "" if there's no cursor (no such page).
+func pageURL(r *http.Request, cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	v := r.URL.Query()
+	v.Set("cursor", cursor)
+	return r.URL.Path + "?" + v.Encode()
+}
+
+// setLinkHeader sets an RFC 8288 Link header with the given relations, skipping any with an empty URL.
+func setLinkHeader(w http.ResponseWriter, links map[string]string) {
+	var parts []string
+	for _, rel := range []string{"first", "prev", "next", "last"} {
+		if url := links[rel]; url != "" {
+			parts = append(parts, fmt.Sprintf(`<%s>; rel="%s"`, url, rel))
+		}
+	}
+	if len(parts) > 0 {
+		w.Header().Set("Link", strings.Join(parts, ", "))
+	}
+}
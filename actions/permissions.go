@@ -0,0 +1,111 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/katabole/kbexample/models"
+)
+
+// Permissions is the set of permissions the current user has, e.g. "users:delete", see models.DefaultRoles. Templates
+// get it as .Permissions, to hide what the user can't do: {{if .Permissions.Can "users:delete"}}.
+type Permissions map[string]bool
+
+// Can reports whether the permission is in the set.
+func (p Permissions) Can(permission string) bool {
+	return p[permission]
+}
+
+type permissionsKey struct{}
+
+// GetPermissions returns the current user's permissions, as loaded by LoadUser or RequireLogin, which are empty if
+// nobody's logged in.
+func GetPermissions(ctx context.Context) Permissions {
+	p, _ := ctx.Value(permissionsKey{}).(Permissions)
+	return p
+}
+
+// withPermissions returns the request with the given permissions for its current user.
+func withPermissions(r *http.Request, p Permissions) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), permissionsKey{}, p))
+}
+
+// setupRoles creates the built-in roles and checks the configured DefaultRole exists, since users without roles would
+// otherwise quietly get no permissions at all.
+func (app *App) setupRoles(ctx context.Context) error {
+	if err := app.users.EnsureRoles(ctx, models.DefaultRoles); err != nil {
+		return fmt.Errorf("could not create roles: %w", err)
+	}
+	if app.conf.DefaultRole == "" {
+		return nil
+	}
+	roles, err := app.users.GetRoles(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get roles: %w", err)
+	}
+	if !slices.ContainsFunc(roles, func(r *models.Role) bool { return r.Name == app.conf.DefaultRole }) {
+		return fmt.Errorf("DEFAULT_ROLE %q is not a role", app.conf.DefaultRole)
+	}
+	return nil
+}
+
+// userPermissions returns the permissions of the user's roles. Users without any roles get those of the configured
+// DefaultRole, if any, and the dev/test stand-in user, who has no ID, gets those of an admin.
+func (app *App) userPermissions(ctx context.Context, user *models.User) (Permissions, error) {
+	var roles []string
+	if user.ID == 0 {
+		roles = []string{models.RoleAdmin}
+	} else {
+		var err error
+		if roles, err = app.users.GetUserRoles(ctx, user.ID); err != nil {
+			return nil, fmt.Errorf("could not get roles of user %d: %w", user.ID, err)
+		}
+		if len(roles) == 0 && app.conf.DefaultRole != "" {
+			roles = []string{app.conf.DefaultRole}
+		}
+	}
+
+	names, err := app.users.GetRolePermissions(ctx, roles)
+	if err != nil {
+		return nil, fmt.Errorf("could not get permissions of roles %v: %w", roles, err)
+	}
+	p := Permissions{}
+	for _, name := range names {
+		p[name] = true
+	}
+	return p, nil
+}
+
+// RequirePermission returns middleware, run after RequireLogin, that responds 403 Forbidden unless the current user
+// has the given permission.
+func (app *App) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !GetPermissions(r.Context()).Can(permission) {
+				app.render.Error(w, r, &ForbiddenError{Err: fmt.Errorf("you need the %s permission to do that", permission)})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bootstrapAdmin makes the user an admin if they have the configured BootstrapAdminEmail and there are no admins yet,
+// so that a new deployment has someone who can give out roles.
+func (app *App) bootstrapAdmin(ctx context.Context, user *models.User) error {
+	if app.conf.BootstrapAdminEmail == "" || !strings.EqualFold(user.Email, app.conf.BootstrapAdminEmail) {
+		return nil
+	}
+	granted, err := app.users.GrantFirstRole(ctx, user.ID, models.RoleAdmin)
+	if err != nil {
+		return fmt.Errorf("could not bootstrap admin: %w", err)
+	}
+	if granted {
+		slog.Info("Made the bootstrap user an admin", "user_id", user.ID, "email", user.Email)
+	}
+	return nil
+}
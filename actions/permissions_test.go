@@ -0,0 +1,258 @@
+package actions
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRBACFixture returns a memory fixture that enforces logins, so users only have the permissions of their roles.
+func newRBACFixture(t *testing.T, c Config) *Fixture {
+	c.EnforceAuth = true
+	users := models.NewMemoryUserStore()
+	f := newFixture(t, c, WithUserStore(users))
+	f.Users = users
+	return f
+}
+
+// TestRequirePermission validates that users can only use the user routes their roles allow, and only see buttons for
+// them.
+func TestRequirePermission(t *testing.T) {
+	t.Parallel()
+	f := newRBACFixture(t, conf)
+	defer f.Cleanup()
+
+	// newUser creates a user with the given roles.
+	newUser := func(name string, roles ...string) *models.User {
+		u, err := f.Users.CreateUser(t.Context(), &models.User{Name: name})
+		require.NoError(t, err)
+		require.NoError(t, f.Users.SetUserRoles(t.Context(), u.ID, roles))
+		return u
+	}
+	admin := newUser("Ada", models.RoleAdmin)
+	editor := newUser("Ed", "editor")
+	viewer := newUser("Vic", "viewer")
+
+	f.Login(viewer)
+	page, err := f.Client.GetPage("/users")
+	require.NoError(t, err)
+	assert.Contains(t, page, "Ada")
+	assert.NotContains(t, page, "New User")
+	assert.NotContains(t, page, ">Edit<")
+	assert.NotContains(t, page, ">Delete<")
+	page, err = f.Client.GetPage(fmt.Sprintf("/users/%d", admin.ID))
+	require.NoError(t, err)
+	assert.NotContains(t, page, ">Edit<")
+	_, err = f.Client.GetPage("/users/new")
+	assert.ErrorContains(t, err, "got 403 code")
+	assert.ErrorContains(t, f.Client.PostJSON("/users", models.User{Name: "Tim"}, nil), "got 403 code")
+
+	f.Login(editor)
+	page, err = f.Client.GetPage(fmt.Sprintf("/users/%d", viewer.ID))
+	require.NoError(t, err)
+	assert.Contains(t, page, ">Edit<")
+	assert.NotContains(t, page, ">Delete<")
+	assert.NotContains(t, page, "Save roles")
+	_, err = f.Client.PutPage(fmt.Sprintf("/users/%d", viewer.ID), url.Values{"name": {"Victor"}})
+	require.NoError(t, err)
+	_, err = f.Client.PostPage(fmt.Sprintf("/users/%d/delete", viewer.ID), nil)
+	assert.ErrorContains(t, err, "got 403 code")
+	assert.ErrorContains(t, f.Client.DeleteJSON(fmt.Sprintf("/users/%d", viewer.ID), nil), "users:delete")
+
+	f.Login(admin)
+	page, err = f.Client.GetPage(fmt.Sprintf("/users/%d", viewer.ID))
+	require.NoError(t, err)
+	assert.Contains(t, page, ">Delete<")
+	assert.Contains(t, page, "Save roles")
+	require.NoError(t, f.Client.DeleteJSON(fmt.Sprintf("/users/%d", viewer.ID), nil))
+}
+
+// TestDefaultRole validates that users without roles get the default role's permissions, if there is one.
+func TestDefaultRole(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		defaultRole string
+		canRead     bool
+	}{
+		{"viewer", true},
+		{"", false},
+	} {
+		t.Run(fmt.Sprintf("%q", tt.defaultRole), func(t *testing.T) {
+			t.Parallel()
+			c := conf
+			c.DefaultRole = tt.defaultRole
+			f := newRBACFixture(t, c)
+			defer f.Cleanup()
+
+			u, err := f.Users.CreateUser(t.Context(), &models.User{Name: "Tim"})
+			require.NoError(t, err)
+			f.Login(u)
+			_, err = f.Client.GetPage("/users")
+			if tt.canRead {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, "got 403 code")
+			}
+		})
+	}
+	c := conf
+	c.DefaultRole = "viewers"
+	_, err := NewApp(c, WithUserStore(models.NewMemoryUserStore()))
+	assert.ErrorContains(t, err, `DEFAULT_ROLE "viewers" is not a role`)
+}
+
+// TestUserRolesPUT validates that admins can change users' roles with a form or JSON.
+func TestUserRolesPUT(t *testing.T) {
+	t.Parallel()
+	f := newRBACFixture(t, conf)
+	defer f.Cleanup()
+
+	admin, err := f.Users.CreateUser(t.Context(), &models.User{Name: "Ada"})
+	require.NoError(t, err)
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), admin.ID, []string{models.RoleAdmin}))
+	u, err := f.Users.CreateUser(t.Context(), &models.User{Name: "Tim"})
+	require.NoError(t, err)
+	f.Login(admin)
+
+	page, err := f.Client.PostPage(fmt.Sprintf("/users/%d/roles", u.ID), url.Values{"role": {"editor", "viewer"}})
+	require.NoError(t, err)
+	assert.Contains(t, page, "Roles updated")
+	assert.Contains(t, page, "editor, viewer")
+
+	var result struct{ Roles []string }
+	require.NoError(t, f.Client.PutJSON(fmt.Sprintf("/users/%d/roles", u.ID), map[string][]string{"roles": {"viewer"}}, &result))
+	assert.Equal(t, []string{"viewer"}, result.Roles)
+
+	err = f.Client.PutJSON(fmt.Sprintf("/users/%d/roles", u.ID), map[string][]string{"roles": {"superuser"}}, nil)
+	assert.ErrorContains(t, err, "got 400 code")
+	roles, err := f.Users.GetUserRoles(t.Context(), u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"viewer"}, roles)
+}
+
+// TestBootstrapAdmin validates that the user with the bootstrap email becomes an admin, unless there already is one.
+func TestBootstrapAdmin(t *testing.T) {
+	t.Parallel()
+	c := conf
+	c.BootstrapAdminEmail = "ada@example.com"
+	f := newRBACFixture(t, c)
+	defer f.Cleanup()
+
+	other, err := f.Users.LoginUser(t.Context(), models.Login{Provider: "google", ProviderUserID: "1", Email: "tim@example.com"})
+	require.NoError(t, err)
+	require.NoError(t, f.App.bootstrapAdmin(t.Context(), other))
+	roles, err := f.Users.GetUserRoles(t.Context(), other.ID)
+	require.NoError(t, err)
+	assert.Empty(t, roles, "only the bootstrap email is made an admin")
+
+	ada, err := f.Users.LoginUser(t.Context(), models.Login{Provider: "google", ProviderUserID: "2", Email: "Ada@example.com"})
+	require.NoError(t, err)
+	require.NoError(t, f.App.bootstrapAdmin(t.Context(), ada))
+	roles, err = f.Users.GetUserRoles(t.Context(), ada.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.RoleAdmin}, roles)
+
+	// Once there's an admin, it's up to them who else becomes one.
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), ada.ID, nil))
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), other.ID, []string{models.RoleAdmin}))
+	require.NoError(t, f.App.bootstrapAdmin(t.Context(), ada))
+	roles, err = f.Users.GetUserRoles(t.Context(), ada.ID)
+	require.NoError(t, err)
+	assert.Empty(t, roles)
+}
+
+// TestDisableUser validates that only admins can disable users, and that they can't disable themselves or the last
+// admin.
+func TestDisableUser(t *testing.T) {
+	t.Parallel()
+	f := newRBACFixture(t, conf)
+	defer f.Cleanup()
+
+	// newUser creates a user with the given roles.
+	newUser := func(name string, roles ...string) *models.User {
+		u, err := f.Users.CreateUser(t.Context(), &models.User{Name: name})
+		require.NoError(t, err)
+		require.NoError(t, f.Users.SetUserRoles(t.Context(), u.ID, roles))
+		return u
+	}
+	admin := newUser("Ada", models.RoleAdmin)
+	editor := newUser("Ed", "editor")
+	// disable asks to disable or enable the user with JSON.
+	disable := func(u *models.User, disabled bool) error {
+		return f.Client.PutJSON(fmt.Sprintf("/users/%d", u.ID), map[string]bool{"disabled": disabled}, nil)
+	}
+
+	f.Login(editor)
+	page, err := f.Client.GetPage(fmt.Sprintf("/users/%d/edit", admin.ID))
+	require.NoError(t, err)
+	assert.NotContains(t, page, `name="disabled"`)
+	assert.ErrorContains(t, disable(admin, true), "got 403 code")
+	_, err = f.Client.PutPage(fmt.Sprintf("/users/%d", admin.ID), url.Values{"name": {"Ada"}, "disabled": {"false", "true"}})
+	assert.ErrorContains(t, err, "got 403 code")
+
+	f.Login(admin)
+	assert.ErrorContains(t, disable(admin, true), "you can't disable yourself")
+	second := newUser("Bea", models.RoleAdmin)
+	require.NoError(t, disable(second, true))
+	f.Login(editor)
+	require.NoError(t, f.Client.PutJSON(fmt.Sprintf("/users/%d", second.ID), map[string]string{"name": "Beatrice"}, nil),
+		"editors can still rename disabled users")
+
+	// With Bea disabled, Ada is the last admin, who can't be disabled even by someone else with permission to.
+	require.NoError(t, f.Users.EnsureRoles(t.Context(), []models.Role{
+		{Name: "moderator", Permissions: []string{models.PermissionUsersUpdate, models.PermissionUsersDisable}},
+	}))
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), editor.ID, []string{"editor", "moderator"}))
+	assert.ErrorContains(t, disable(admin, true), "you can't remove the last active admin")
+	require.NoError(t, disable(second, false))
+	require.NoError(t, disable(admin, true))
+}
+
+// TestLastAdmin validates that admins can't delete themselves or remove their own admin role, and that nobody can
+// delete or demote the last admin.
+func TestLastAdmin(t *testing.T) {
+	t.Parallel()
+	f := newRBACFixture(t, conf)
+	defer f.Cleanup()
+
+	// newUser creates a user with the given roles.
+	newUser := func(name string, roles ...string) *models.User {
+		u, err := f.Users.CreateUser(t.Context(), &models.User{Name: name})
+		require.NoError(t, err)
+		require.NoError(t, f.Users.SetUserRoles(t.Context(), u.ID, roles))
+		return u
+	}
+	require.NoError(t, f.Users.EnsureRoles(t.Context(), []models.Role{
+		{Name: "manager", Permissions: []string{models.PermissionUsersDelete, models.PermissionUsersRoles}},
+	}))
+	admin := newUser("Ada", models.RoleAdmin)
+	second := newUser("Bea", models.RoleAdmin)
+	manager := newUser("Max", "manager")
+	// setRoles replaces the user's roles with JSON.
+	setRoles := func(u *models.User, roles ...string) error {
+		return f.Client.PutJSON(fmt.Sprintf("/users/%d/roles", u.ID), map[string][]string{"roles": roles}, nil)
+	}
+
+	f.Login(admin)
+	assert.ErrorContains(t, f.Client.DeleteJSON(fmt.Sprintf("/users/%d", admin.ID), nil), "you can't delete yourself")
+	assert.ErrorContains(t, setRoles(admin, "editor"), "you can't remove your own admin role")
+	require.NoError(t, setRoles(admin, models.RoleAdmin, "editor"), "admins can still add to their own roles")
+	require.NoError(t, setRoles(second, "editor"))
+
+	// Ada is now the last admin, who can't be deleted or demoted even by someone else with permission to.
+	f.Login(manager)
+	err := f.Client.DeleteJSON(fmt.Sprintf("/users/%d", admin.ID), nil)
+	assert.ErrorContains(t, err, "got 409 code")
+	assert.ErrorContains(t, err, "you can't remove the last active admin")
+	assert.ErrorContains(t, setRoles(admin, "viewer"), "you can't remove the last active admin")
+	roles, err := f.Users.GetUserRoles(t.Context(), admin.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.RoleAdmin, "editor"}, roles)
+
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), second.ID, []string{models.RoleAdmin}))
+	require.NoError(t, f.Client.DeleteJSON(fmt.Sprintf("/users/%d", admin.ID), nil))
+}
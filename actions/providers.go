@@ -0,0 +1,160 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/gitlab"
+	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/microsoftonline"
+	"github.com/markbates/goth/providers/okta"
+	"github.com/markbates/goth/providers/openidConnect"
+)
+
+// AuthProvider is an identity provider users can log in with, as listed on the login page.
+type AuthProvider struct {
+	// Name identifies the provider in URLs, e.g. "github" in /auth/github/callback.
+	Name string
+	// DisplayName is what the login page calls it, e.g. "GitHub".
+	DisplayName string
+
+	goth goth.Provider
+	// verifiesEmails is whether the provider only gives out email addresses its users have proven they own, which
+	// LoginUser relies on, see emailVerified.
+	verifiesEmails bool
+}
+
+// providerRegistry is every kind of provider the app supports. Each is enabled by setting its client ID (key) in the
+// config.
+var providerRegistry = []struct {
+	name, displayName string
+	verifiesEmails    bool
+	enabled           func(conf Config) bool
+	new               func(conf Config, callbackURL string) (goth.Provider, error)
+}{
+	{
+		name: "google", displayName: "Google", verifiesEmails: true,
+		enabled: func(conf Config) bool { return conf.GoogleOAuthKey != "" },
+		new: func(conf Config, callbackURL string) (goth.Provider, error) {
+			p := google.New(conf.GoogleOAuthKey, conf.GoogleOAuthSecret, callbackURL)
+			p.SetHostedDomain(conf.googleHostedDomain())
+			return p, nil
+		},
+	},
+	{
+		name: "github", displayName: "GitHub", verifiesEmails: true,
+		enabled: func(conf Config) bool { return conf.GitHubOAuthKey != "" },
+		new: func(conf Config, callbackURL string) (goth.Provider, error) {
+			return github.New(conf.GitHubOAuthKey, conf.GitHubOAuthSecret, callbackURL, "read:user", "user:email"), nil
+		},
+	},
+	{
+		// GitLab, self-managed instances especially, can give out a primary email that hasn't been confirmed, so it's
+		// only trusted once confirmed_at says it has, see emailVerified.
+		name: "gitlab", displayName: "GitLab",
+		enabled: func(conf Config) bool { return conf.GitLabOAuthKey != "" },
+		new: func(conf Config, callbackURL string) (goth.Provider, error) {
+			// GitLabURL points at a self-managed instance rather than gitlab.com.
+			base := strings.TrimSuffix(conf.GitLabURL, "/")
+			return gitlab.NewCustomisedURL(conf.GitLabOAuthKey, conf.GitLabOAuthSecret, callbackURL,
+				base+"/oauth/authorize", base+"/oauth/token", base+"/api/v4/user", "read_user"), nil
+		},
+	},
+	{
+		// Microsoft lets directory admins set users' email addresses to anything, so they can't be trusted.
+		name: "microsoft", displayName: "Microsoft",
+		enabled: func(conf Config) bool { return conf.MicrosoftOAuthKey != "" },
+		new: func(conf Config, callbackURL string) (goth.Provider, error) {
+			return microsoftonline.New(conf.MicrosoftOAuthKey, conf.MicrosoftOAuthSecret, callbackURL), nil
+		},
+	},
+	{
+		name: "okta", displayName: "Okta", verifiesEmails: true,
+		enabled: func(conf Config) bool { return conf.OktaOAuthKey != "" },
+		new: func(conf Config, callbackURL string) (goth.Provider, error) {
+			if conf.OktaOrgURL == "" {
+				return nil, fmt.Errorf("OKTA_ORG_URL must be set along with OKTA_OAUTH_KEY")
+			}
+			return okta.New(conf.OktaOAuthKey, conf.OktaOAuthSecret, strings.TrimSuffix(conf.OktaOrgURL, "/"), callbackURL,
+				"openid", "profile", "email"), nil
+		},
+	},
+	{
+		// Any OpenID Connect provider, found with discovery from its issuer. It's named by OIDCName. We can't know how
+		// it checks emails, so they're only trusted when its email_verified claim says so.
+		name: "oidc", displayName: "OpenID Connect",
+		enabled: func(conf Config) bool { return conf.OIDCClientID != "" },
+		new: func(conf Config, callbackURL string) (goth.Provider, error) {
+			if conf.OIDCIssuerURL == "" {
+				return nil, fmt.Errorf("OIDC_ISSUER_URL must be set along with OIDC_CLIENT_ID")
+			}
+			discoveryURL := strings.TrimSuffix(conf.OIDCIssuerURL, "/") + "/.well-known/openid-configuration"
+			p, err := openidConnect.New(conf.OIDCClientID, conf.OIDCClientSecret, callbackURL, discoveryURL,
+				"openid", "profile", "email")
+			if err != nil {
+				return nil, fmt.Errorf("could not discover OpenID Connect issuer %s: %w", conf.OIDCIssuerURL, err)
+			}
+			return p, nil
+		},
+	},
+}
+
+// authProviders returns the providers enabled by the config, in the order they're listed on the login page.
+func (conf Config) authProviders() ([]*AuthProvider, error) {
+	var providers []*AuthProvider
+	for _, r := range providerRegistry {
+		if !r.enabled(conf) {
+			continue
+		}
+		p := &AuthProvider{Name: r.name, DisplayName: r.displayName, verifiesEmails: r.verifiesEmails}
+		if r.name == "oidc" {
+			if conf.OIDCName != "" {
+				p.Name = conf.OIDCName
+			}
+			if conf.OIDCDisplayName != "" {
+				p.DisplayName = conf.OIDCDisplayName
+			}
+		}
+
+		var err error
+		if p.goth, err = r.new(conf, conf.SiteURL+"/auth/"+p.Name+"/callback"); err != nil {
+			return nil, fmt.Errorf("could not set up %s login: %w", r.displayName, err)
+		}
+		if named, ok := p.goth.(interface{ SetName(string) }); ok {
+			named.SetName(p.Name)
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// authProvider returns the enabled provider with the given name, or nil if there isn't one.
+func (app *App) authProvider(name string) *AuthProvider {
+	for _, p := range app.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// emailVerified reports whether the email the user logged in with is one they've proven they own. Providers that say
+// so in an email_verified claim (verified_email for Google), or for GitLab a confirmed_at time, are taken at their
+// word, otherwise it's up to whether the provider checks them at all.
+func (p *AuthProvider) emailVerified(user goth.User) bool {
+	for _, claim := range []string{"email_verified", "verified_email"} {
+		switch v := user.RawData[claim].(type) {
+		case bool:
+			return v
+		case string:
+			return v == "true"
+		}
+	}
+	if confirmedAt, ok := user.RawData["confirmed_at"]; ok {
+		s, _ := confirmedAt.(string)
+		return s != ""
+	}
+	return p.verifiesEmails
+}
@@ -0,0 +1,223 @@
+package actions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOIDCIssuer is a local OpenID Connect provider for tests, which logs in whoever its claims say without asking.
+type fakeOIDCIssuer struct {
+	*httptest.Server
+	clientID string
+	// claims are the ID token claims of the user logged in next, on top of the standard ones.
+	claims map[string]any
+}
+
+func newFakeOIDCIssuer(t *testing.T, clientID string) *fakeOIDCIssuer {
+	issuer := &fakeOIDCIssuer{clientID: clientID}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+		})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != clientID {
+			http.Error(w, "unknown client", http.StatusBadRequest)
+			return
+		}
+		redirect, err := url.Parse(q.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		redirect.RawQuery = url.Values{"code": {"the-code"}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "the-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := map[string]any{"iss": issuer.URL, "aud": clientID, "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range issuer.claims {
+			claims[k] = v
+		}
+		payload, _ := json.Marshal(claims)
+		// goth doesn't check the signature of ID tokens it fetches itself, so this one isn't signed.
+		idToken := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "the-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// TestOIDCLogin validates logging in with an OpenID Connect provider, through the login page and the provider's
+// callback, trusting the email it gives only once it says it's verified.
+func TestOIDCLogin(t *testing.T) {
+	t.Parallel()
+	issuer := newFakeOIDCIssuer(t, "kbexample")
+	c := conf
+	c.EnforceAuth = true
+	c.OIDCClientID = "kbexample"
+	c.OIDCClientSecret = "secret"
+	c.OIDCIssuerURL = issuer.URL
+	c.OIDCName = "corp"
+	c.OIDCDisplayName = "Corp SSO"
+	users := models.NewMemoryUserStore()
+	f := newFixture(t, c, WithUserStore(users))
+	defer f.Cleanup()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	f.Client.Client = &http.Client{Jar: jar}
+
+	page, err := f.Client.GetPage("/users")
+	require.NoError(t, err, "redirected to the login page")
+	assert.Contains(t, page, `href="/auth?provider=corp"`)
+	assert.Contains(t, page, "Log in with Corp SSO")
+
+	issuer.claims = map[string]any{"sub": "ada-1", "name": "Ada Lovelace", "email": "ada@example.com", "email_verified": false}
+	page, err = f.Client.GetPage("/auth?provider=corp")
+	require.NoError(t, err)
+	assert.Contains(t, page, "Ada Lovelace", "logged in")
+	u, err := users.GetUserByID(t.Context(), 1)
+	require.NoError(t, err)
+	assert.Empty(t, u.Email, "the email isn't verified")
+	identities, err := users.GetUserIdentities(t.Context(), u.ID)
+	require.NoError(t, err)
+	require.Len(t, identities, 1)
+	assert.Equal(t, "corp", identities[0].Provider)
+	assert.Equal(t, "ada-1", identities[0].ProviderUserID)
+
+	_, err = f.Client.GetPage("/logout")
+	require.NoError(t, err)
+	issuer.claims["email_verified"] = true
+	_, err = f.Client.GetPage("/auth?provider=corp")
+	require.NoError(t, err)
+	u, err = users.GetUserByID(t.Context(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "ada@example.com", u.Email, "filled in once it's verified")
+}
+
+// TestOIDCLoginPerApp validates that apps keep their own providers and login state, so two apps in one process can
+// each log users in with a different provider of the same name, and a login's callback can't be replayed.
+func TestOIDCLoginPerApp(t *testing.T) {
+	t.Parallel()
+	// newApp returns a fixture for an app whose "oidc" provider is a new issuer, with a client jar so logins work.
+	newApp := func(clientID string) (*Fixture, *fakeOIDCIssuer) {
+		issuer := newFakeOIDCIssuer(t, clientID)
+		c := conf
+		c.EnforceAuth = true
+		c.OIDCClientID = clientID
+		c.OIDCClientSecret = "secret"
+		c.OIDCIssuerURL = issuer.URL
+		f := newFixture(t, c, WithUserStore(models.NewMemoryUserStore()))
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		f.Client.Client = &http.Client{Jar: jar}
+		return f, issuer
+	}
+	first, firstIssuer := newApp("first")
+	defer first.Cleanup()
+	second, secondIssuer := newApp("second")
+	defer second.Cleanup()
+	firstIssuer.claims = map[string]any{"sub": "ada-1", "name": "Ada Lovelace"}
+	secondIssuer.claims = map[string]any{"sub": "bea-1", "name": "Bea Baker"}
+
+	page, err := first.Client.GetPage("/auth?provider=oidc")
+	require.NoError(t, err, "logged in with the first app's issuer, though the second app was created since")
+	assert.Contains(t, page, "Ada Lovelace")
+	page, err = second.Client.GetPage("/auth?provider=oidc")
+	require.NoError(t, err)
+	assert.Contains(t, page, "Bea Baker")
+
+	_, err = first.Client.GetPage("/logout")
+	require.NoError(t, err)
+	_, err = first.Client.GetPage("/auth/oidc/callback?" + url.Values{"code": {"the-code"}, "state": {"forged"}}.Encode())
+	assert.ErrorContains(t, err, "got 401 code", "there's no login in progress to finish")
+}
+
+// TestAuthProviders validates that only the providers with keys are enabled, and unknown ones aren't found.
+func TestAuthProviders(t *testing.T) {
+	t.Parallel()
+	c := conf
+	c.GoogleOAuthKey = ""
+	c.GitHubOAuthKey = "github-key"
+	c.OktaOAuthKey = "okta-key"
+	c.OktaOrgURL = "https://example.okta.com/"
+	f := newFixture(t, c, WithUserStore(models.NewMemoryUserStore()))
+	defer f.Cleanup()
+
+	var names []string
+	for _, p := range f.App.providers {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"github", "okta"}, names)
+	page, err := f.Client.GetPage("/login")
+	require.NoError(t, err)
+	assert.Contains(t, page, "Log in with GitHub")
+	assert.NotContains(t, page, "Log in with Google")
+
+	_, err = f.Client.GetPage("/auth?provider=google")
+	assert.ErrorContains(t, err, "got 404 code")
+	_, err = f.Client.GetPage("/auth/google/callback")
+	assert.ErrorContains(t, err, "got 404 code")
+
+	c.OktaOrgURL = ""
+	_, err = NewApp(c, WithUserStore(models.NewMemoryUserStore()))
+	assert.ErrorContains(t, err, "OKTA_ORG_URL must be set")
+}
+
+// TestEmailVerified validates that emails are only trusted when the provider says they're verified, or always verifies
+// them.
+func TestEmailVerified(t *testing.T) {
+	trusting := &AuthProvider{verifiesEmails: true}
+	wary := &AuthProvider{}
+	tests := []struct {
+		name     string
+		provider *AuthProvider
+		rawData  map[string]any
+		want     bool
+	}{
+		{"verified claim", wary, map[string]any{"email_verified": true}, true},
+		{"unverified claim", trusting, map[string]any{"email_verified": false}, false},
+		{"string claim", wary, map[string]any{"email_verified": "true"}, true},
+		{"Google claim", wary, map[string]any{"verified_email": true}, true},
+		{"GitLab confirmed", wary, map[string]any{"confirmed_at": "2024-01-02T03:04:05Z"}, true},
+		{"GitLab unconfirmed", trusting, map[string]any{"confirmed_at": nil}, false},
+		{"no claim from a provider that verifies", trusting, nil, true},
+		{"no claim from a provider that may not", wary, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.provider.emailVerified(goth.User{RawData: tt.rawData}))
+		})
+	}
+
+	for _, p := range providerRegistry {
+		if p.name == "gitlab" || p.name == "oidc" {
+			assert.False(t, p.verifiesEmails, "%s emails are only trusted when it says they're verified", p.name)
+		}
+	}
+}
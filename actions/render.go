@@ -1,15 +1,26 @@
 package actions
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/katabole/kbexample/build"
+	"github.com/katabole/kbexample/models"
 	"github.com/katabole/kbexample/templates"
 	"github.com/katabole/kbsession"
 	"github.com/olivere/vite"
 	"github.com/unrolled/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Renderer wraps the unrolled/render package in order to provide a few goodies (error rendering, session saving).
@@ -17,6 +28,8 @@ type Renderer struct {
 	rnd          *render.Render
 	isProduction bool
 	viteFragment *vite.Fragment
+	// revocableSessions is set when sessions are stored server-side, so the layout can offer to log out everywhere.
+	revocableSessions bool
 }
 
 func NewRenderer(isProduction bool) (*Renderer, error) {
@@ -74,7 +87,16 @@ type HTMLParams struct {
 }
 
 // HTML builds up the response from the specified parameters.
-func (r *Renderer) HTML(w http.ResponseWriter, req *http.Request, params HTMLParams) error {
+func (r *Renderer) HTML(w http.ResponseWriter, req *http.Request, params HTMLParams) (err error) {
+	_, span := otel.Tracer(tracerName).Start(req.Context(), "render "+params.Template,
+		trace.WithAttributes(attribute.String("template", params.Template)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	flash := kbsession.Flash(req)
 	session := kbsession.Get(req)
 	kbsession.Save(w, req)
@@ -91,6 +113,10 @@ func (r *Renderer) HTML(w http.ResponseWriter, req *http.Request, params HTMLPar
 		"Title":   params.Title,
 		"Vite":    r.viteFragment,
 		"Data":    params.Data,
+
+		"CurrentUser":       GetCurrentUser(req.Context()),
+		"Permissions":       GetPermissions(req.Context()),
+		"RevocableSessions": r.revocableSessions,
 	}, params.HTMLOptions...)
 }
 
@@ -100,6 +126,43 @@ func (r *Renderer) JSON(w http.ResponseWriter, req *http.Request, status int, v
 	return r.rnd.JSON(w, status, v)
 }
 
+// Encode writes v in whichever data format the client asked for (see encoding.go), defaulting to JSON. Use it for
+// responses that aren't HTML, or are the same data as a page would show.
+func (r *Renderer) Encode(w http.ResponseWriter, req *http.Request, status int, v any) error {
+	enc, ok := encoders[GetContentType(req)]
+	if !ok {
+		enc = encoders[ContentTypeJSON]
+	}
+	return r.encode(w, req, status, v, enc, enc.MediaType())
+}
+
+// encode buffers the encoded value before writing anything, so that encoding errors can still become a clean 500.
+// The encoder's error is logged rather than sent, as it can reveal internals.
+func (r *Renderer) encode(w http.ResponseWriter, req *http.Request, status int, v any, enc Encoder, mediaType string) error {
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, v); err != nil {
+		requestID := GetRequestID(req.Context())
+		slog.Error("Failed to encode response", "err", err, "request_id", requestID)
+		body, _ := json.Marshal(&Problem{
+			Type:      "about:blank",
+			Title:     http.StatusText(http.StatusInternalServerError),
+			Status:    http.StatusInternalServerError,
+			Detail:    "internal error, see logs for details",
+			Instance:  req.URL.RequestURI(),
+			RequestID: requestID,
+		})
+		w.Header().Set("Content-Type", "application/problem+json; charset=UTF-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(body)
+		return err
+	}
+	kbsession.Save(w, req)
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
 // JSONP marshals the given interface object and writes the JSON response.
 func (r *Renderer) JSONP(w http.ResponseWriter, req *http.Request, status int, callback string, v interface{}) error {
 	kbsession.Save(w, req)
@@ -123,39 +186,91 @@ func (r *Renderer) Redirect(w http.ResponseWriter, req *http.Request, url string
 	http.Redirect(w, req, url, status)
 }
 
-// Error figures out how to render the given error message appropriate to the expected content type, while showing full
-// error messages in dev but not in production.
-func (r *Renderer) Error(w http.ResponseWriter, req *http.Request, status int, err error) {
+// Problem is an RFC 9457 problem details object, the body of our error responses for anything but HTML.
+type Problem struct {
+	XMLName xml.Name `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	// Type is a URI identifying the kind of problem, "about:blank" when the status code says it all.
+	Type   string `json:"type" xml:"type"`
+	Title  string `json:"title" xml:"title"`
+	Status int    `json:"status" xml:"status"`
+	Detail string `json:"detail,omitempty" xml:"detail,omitempty"`
+	// Instance identifies this occurrence of the problem, which is the request's URI.
+	Instance  string `json:"instance,omitempty" xml:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty" xml:"request_id,omitempty"`
+	// Errors holds invalid fields and what's wrong with them, for validation problems. XML can't encode maps, so there
+	// they're listed in XMLErrors instead.
+	Errors    models.ValidationErrors `json:"errors,omitempty" xml:"-"`
+	XMLErrors []problemFieldError     `json:"-" xml:"errors>error,omitempty"`
+}
+
+type problemFieldError struct {
+	Field   string `xml:"field,attr"`
+	Message string `xml:",chardata"`
+}
+
+// problem describes the given error. The status comes from the error type (see errors.go), defaulting to 500 Internal
+// Server Error, whose details are hidden in production since they can reveal internals.
+func (r *Renderer) problem(req *http.Request, err error) *Problem {
+	p := &Problem{
+		Type:      "about:blank",
+		Status:    http.StatusInternalServerError,
+		Detail:    err.Error(),
+		Instance:  req.URL.RequestURI(),
+		RequestID: GetRequestID(req.Context()),
+	}
+
+	var sc StatusCoder
+	if errors.As(err, &sc) {
+		p.Status = sc.StatusCode()
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		p.Errors = ve.Fields
+		for field, msg := range ve.Fields {
+			p.XMLErrors = append(p.XMLErrors, problemFieldError{Field: field, Message: msg})
+		}
+		slices.SortFunc(p.XMLErrors, func(a, b problemFieldError) int { return strings.Compare(a.Field, b.Field) })
+	}
+	p.Title = http.StatusText(p.Status)
+
+	if p.Status >= 500 {
+		slog.Error("Internal error", "err", err, "request_id", p.RequestID)
+		if r.isProduction {
+			p.Detail = "internal error, see logs for details"
+		}
+	}
+	return p
+}
+
+// Error figures out how to render the given error appropriate to the expected content type. The response status and
+// how much detail to show depend on the type of error, see errors.go.
+func (r *Renderer) Error(w http.ResponseWriter, req *http.Request, err error) {
 	switch GetContentType(req) {
 	case ContentTypeHTML:
-		r.HTMLError(w, req, status, err)
+		r.HTMLError(w, req, err)
+	case ContentTypeXML:
+		r.problemResponse(w, req, r.problem(req, err), xmlEncoder{}, "application/problem+xml; charset=UTF-8")
+	case ContentTypeMsgPack:
+		r.problemResponse(w, req, r.problem(req, err), msgpackEncoder{}, msgpackEncoder{}.MediaType())
 	default:
-		r.JSONError(w, req, status, err)
+		// CSV and NDJSON can't really describe an error, clients of those get JSON.
+		r.JSONError(w, req, err)
 	}
 }
 
-// HTMLError sends the user an HTML error page, hiding error details in production.
-func (r *Renderer) HTMLError(w http.ResponseWriter, req *http.Request, status int, err error) {
-	if r.isProduction {
-		slog.Info("Internal error", "err", err)
-		r.HTML(w, req, HTMLParams{
-			Status:   status,
-			Template: "error",
-			Data:     map[string]string{"Message": "internal error, see logs for details"},
-		})
-		return
-	}
+// HTMLError sends the user an HTML error page.
+func (r *Renderer) HTMLError(w http.ResponseWriter, req *http.Request, err error) {
+	p := r.problem(req, err)
+	r.HTML(w, req, HTMLParams{Status: p.Status, Template: "error", Title: p.Title, Data: p})
+}
 
-	r.HTML(w, req, HTMLParams{Status: status, Template: "error", Data: map[string]string{"Message": err.Error()}})
+// JSONError sends the user an application/problem+json error payload.
+func (r *Renderer) JSONError(w http.ResponseWriter, req *http.Request, err error) {
+	r.problemResponse(w, req, r.problem(req, err), jsonEncoder{}, "application/problem+json; charset=UTF-8")
 }
 
-// JSONError sends the user a JSON error payload, hiding error details in production.
-func (r *Renderer) JSONError(w http.ResponseWriter, req *http.Request, status int, err error) {
-	if r.isProduction {
-		slog.Info("Internal error", "err", err)
-		r.JSON(w, req, status, map[string]string{"message": "internal error, see logs for details"})
-		return
+func (r *Renderer) problemResponse(w http.ResponseWriter, req *http.Request, p *Problem, enc Encoder, mediaType string) {
+	if err := r.encode(w, req, p.Status, p, enc, mediaType); err != nil {
+		slog.Error("Failed to render error", "err", err, "request_id", p.RequestID)
 	}
-
-	r.JSON(w, req, status, map[string]string{"message": err.Error()})
 }
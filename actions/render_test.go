@@ -0,0 +1,88 @@
+package actions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestErrorProblemJSON validates that JSON errors are rendered as RFC 9457 problem details.
+func TestErrorProblemJSON(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	req, err := http.NewRequest(http.MethodGet, "/users/12345", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "application/problem+json; charset=UTF-8", resp.Header.Get("Content-Type"))
+
+	var p Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+	assert.Equal(t, "about:blank", p.Type)
+	assert.Equal(t, "Not Found", p.Title)
+	assert.Equal(t, http.StatusNotFound, p.Status)
+	assert.Equal(t, "User ID 12345 not found", p.Detail)
+	assert.Equal(t, "/users/12345", p.Instance)
+	assert.NotEmpty(t, p.RequestID)
+}
+
+// TestErrorDetailByType validates that the error type decides the status and whether details are shown in production.
+func TestErrorDetailByType(t *testing.T) {
+	r := &Renderer{isProduction: true}
+	req := httptest.NewRequest(http.MethodGet, "/users?x=1", nil)
+
+	p := r.problem(req, errors.New("connection refused to 10.0.0.5"))
+	assert.Equal(t, http.StatusInternalServerError, p.Status)
+	assert.NotContains(t, p.Detail, "10.0.0.5")
+
+	p = r.problem(req, fmt.Errorf("loading user: %w", &NotFoundError{Err: errors.New("User ID 5 not found")}))
+	assert.Equal(t, http.StatusNotFound, p.Status)
+	assert.Equal(t, "loading user: User ID 5 not found", p.Detail)
+	assert.Equal(t, "/users?x=1", p.Instance)
+
+	p = r.problem(req, &ValidationError{Fields: models.ValidationErrors{"name": "must not be blank"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, p.Status)
+	assert.Equal(t, "Unprocessable Entity", p.Title)
+	assert.Equal(t, models.ValidationErrors{"name": "must not be blank"}, p.Errors)
+
+	for _, err := range []error{
+		&BadRequestError{Err: errors.New("x")},
+		&UnauthorizedError{Err: errors.New("x")},
+		&ForbiddenError{Err: errors.New("x")},
+		&ConflictError{Err: errors.New("x")},
+	} {
+		var sc StatusCoder
+		require.ErrorAs(t, err, &sc)
+		assert.Equal(t, sc.StatusCode(), r.problem(req, err).Status)
+		assert.Equal(t, "x", r.problem(req, err).Detail)
+	}
+}
+
+// TestEncodeFailure validates that a response that can't be encoded becomes a problem without the encoder's error.
+func TestEncodeFailure(t *testing.T) {
+	r := &Renderer{}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/users.csv", nil)
+
+	err := r.encode(w, req, http.StatusOK, []string{"a"}, encoders[ContentTypeCSV], encoders[ContentTypeCSV].MediaType())
+	require.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "application/problem+json; charset=UTF-8", w.Header().Get("Content-Type"))
+	var p Problem
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&p))
+	assert.Equal(t, http.StatusInternalServerError, p.Status)
+	assert.NotContains(t, p.Detail, err.Error())
+}
@@ -1,37 +1,67 @@
 package actions
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
 	"os"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/katabole/kbexample/build"
-	"github.com/markbates/goth/gothic"
+	"github.com/katabole/kbexample/models"
 	"github.com/olivere/vite"
 )
 
 // defineRoutes is the part of app setup where routes/endpoints are defined.
 // For how to define these routes on the chi Mux, see https://go-chi.io/#/pages/routing
 func (app *App) defineRoutes(r *chi.Mux) error {
-	r.Get("/auth", gothic.BeginAuthHandler)
-	r.Get("/auth/google/callback", app.AuthCallback)
-
-	r.Get("/", app.HomeGET)
-	r.Get("/logout", app.LogoutGET)
+	r.Get("/auth", app.AuthGET)
+	r.Get("/auth/{provider}/callback", app.AuthCallback)
 
 	r.Group(func(r chi.Router) {
-		r.Use(app.RequireLogin)
-		r.Get("/users/new", app.UserNewGET)
-		r.Post("/users", app.UserPOST)
-		r.Get("/users/{id}", app.UserGET)
-		r.Get("/users/{id}/edit", app.UserEditGET)
-		r.Put("/users/{id}", app.UserPUT)
-		r.Post("/users/{id}/update", app.UserPUT)
-		r.Delete("/users/{id}", app.UserDELETE)
-		r.Post("/users/{id}/delete", app.UserDELETE)
-		r.Get("/users", app.UsersGET)
+		r.Use(app.LoadUser)
+		r.Get("/", app.HomeGET)
+		r.Get("/login", app.LoginGET)
+		r.Get("/logout", app.LogoutGET)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequireAcceptable)
+			r.Use(app.RequireLogin)
+			r.Post("/logout/all", app.LogoutAllPOST)
+			r.Get("/settings/tokens", app.TokensGET)
+			r.Post("/settings/tokens", app.TokenPOST)
+			r.Delete("/settings/tokens/{id}", app.TokenDELETE)
+			r.Post("/settings/tokens/{id}/delete", app.TokenDELETE)
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(models.PermissionUsersRead))
+				r.Get("/users/export", app.UsersExportGET)
+				r.Get("/users/{id}", app.UserGET)
+				r.Get("/users", app.UsersGET)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(models.PermissionUsersCreate))
+				r.Get("/users/new", app.UserNewGET)
+				r.Get("/users/import", app.UsersImportGET)
+				r.Post("/users/import", app.UsersImportPOST)
+				r.Post("/users", app.UserPOST)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(models.PermissionUsersUpdate))
+				r.Get("/users/{id}/edit", app.UserEditGET)
+				r.Put("/users/{id}", app.UserPUT)
+				r.Post("/users/{id}/update", app.UserPUT)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(models.PermissionUsersDelete))
+				r.Delete("/users/{id}", app.UserDELETE)
+				r.Post("/users/{id}/delete", app.UserDELETE)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequirePermission(models.PermissionUsersRoles))
+				r.Put("/users/{id}/roles", app.UserRolesPUT)
+				r.Post("/users/{id}/roles", app.UserRolesPUT)
+			})
+		})
 	})
 
 	// For any special file that needs to be served not under /assets/, add the route here.
@@ -48,7 +78,7 @@ func (app *App) defineRoutes(r *chi.Mux) error {
 	r.Handle("/assets/*", assetHandler)
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
-		app.render.Error(w, r, http.StatusNotFound, errors.New("404 Not Found"))
+		app.render.Error(w, r, &NotFoundError{Err: fmt.Errorf("no page found at %s", r.URL.Path)})
 	})
 	return nil
 }
@@ -0,0 +1,87 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/katabole/kbsession"
+)
+
+// errSessionsNotRevocable is returned by the session revocation endpoints when sessions live in cookies.
+var errSessionsNotRevocable = errors.New("sessions can only be revoked when SESSION_STORE=postgres")
+
+// cleanupSessions periodically deletes expired sessions from the database until the app stops.
+func (app *App) cleanupSessions() {
+	ticker := time.NewTicker(app.conf.SessionCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			n, err := app.sessions.DeleteExpired(ctx)
+			cancel()
+			if err != nil {
+				slog.Error("Failed to delete expired sessions", "err", err)
+			} else if n > 0 {
+				slog.Info("Deleted expired sessions", "count", n)
+			}
+		}
+	}
+}
+
+// LogoutAllPOST handles POST /logout/all, logging the current user out of every session they have, on any device.
+func (app *App) LogoutAllPOST(w http.ResponseWriter, r *http.Request) {
+	// API tokens of any scope could otherwise log their user out everywhere, and skip cross-origin protection.
+	if GetAPIToken(r.Context()) != nil {
+		app.render.Error(w, r, &ForbiddenError{Err: errors.New("API tokens can't be used to log out")})
+		return
+	}
+	if app.sessions == nil {
+		app.render.Error(w, r, &NotFoundError{Err: errSessionsNotRevocable})
+		return
+	}
+
+	// The dev/test stand-in user has no ID, so just has this session to log out of.
+	if user := GetCurrentUser(r.Context()); user.ID != 0 {
+		if _, err := app.sessions.RevokeSessions(r.Context(), strconv.Itoa(user.ID)); err != nil {
+			app.render.Error(w, r, err)
+			return
+		}
+	}
+	s := kbsession.Get(r)
+	app.metrics.logouts.Inc()
+	clear(s.Values)
+	s.Options.MaxAge = -1
+	app.render.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// SessionsDELETE handles DELETE /sessions?user_id=<ID> on the admin listener, revoking every session of the given user
+// so that e.g. a stolen cookie stops working.
+func (app *App) SessionsDELETE(w http.ResponseWriter, r *http.Request) {
+	// The admin listener has no sessions for the Renderer to save, so respond directly.
+	if app.sessions == nil {
+		http.Error(w, errSessionsNotRevocable.Error(), http.StatusNotFound)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "user_id must be a user's ID", http.StatusBadRequest)
+		return
+	}
+
+	n, err := app.sessions.RevokeSessions(r.Context(), strconv.Itoa(userID))
+	if err != nil {
+		slog.Error("Failed to revoke sessions", "err", err, "request_id", GetRequestID(r.Context()))
+		http.Error(w, "could not revoke sessions, see logs for details", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Revoked sessions", "user_id", userID, "count", n, "request_id", GetRequestID(r.Context()))
+	w.Header().Set("Content-Type", encoders[ContentTypeJSON].MediaType())
+	encoders[ContentTypeJSON].Encode(w, map[string]int64{"revoked": n})
+}
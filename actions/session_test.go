@@ -0,0 +1,81 @@
+package actions
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/katabole/kbexample/models/dbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLogoutAllNeedsServerSessions validates that logging out everywhere isn't offered with cookie sessions.
+func TestLogoutAllNeedsServerSessions(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	page, err := f.Client.GetPage("/users")
+	require.NoError(t, err)
+	assert.NotContains(t, page, "/logout/all")
+
+	req, err := http.NewRequest(http.MethodPost, f.URL("/logout/all"), nil)
+	require.NoError(t, err)
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// TestSessionRevocation validates that with sessions in the database, users can log out everywhere.
+func TestSessionRevocation(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, setupDB())
+	c := conf
+	c.DBConfig.Schema = dbtest.NewSchema(t, conf.DBConfig.URL())
+	c.SessionStore = "postgres"
+	f := newFixture(t, c)
+	defer f.Cleanup()
+
+	// Log in twice, as if on two devices.
+	u, err := f.App.users.LoginUser(t.Context(), models.Login{Provider: "google", ProviderUserID: "1", Email: "tim@example.com"})
+	require.NoError(t, err)
+	f.Login(u)
+	f.Login(u)
+	page, err := f.Client.GetPage("/users")
+	require.NoError(t, err)
+	assert.Contains(t, page, "/logout/all")
+	var count int
+	require.NoError(t, f.App.db.GetContext(t.Context(), &count, "SELECT count(*) FROM sessions WHERE owner=$1", strconv.Itoa(u.ID)))
+	assert.Equal(t, 2, count)
+
+	req, err := http.NewRequest(http.MethodPost, f.URL("/logout/all"), strings.NewReader(""))
+	require.NoError(t, err)
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "redirected home")
+	require.NoError(t, f.App.db.GetContext(t.Context(), &count, "SELECT count(*) FROM sessions"))
+	assert.Equal(t, 0, count)
+}
+
+// TestSessionStoreConfig validates that NewApp rejects session stores it can't set up.
+func TestSessionStoreConfig(t *testing.T) {
+	t.Parallel()
+	c := conf
+	c.SessionStore = "redis"
+	_, err := NewApp(c, WithUserStore(models.NewMemoryUserStore()))
+	assert.ErrorContains(t, err, "unknown SESSION_STORE")
+
+	c.SessionStore = "postgres"
+	_, err = NewApp(c, WithUserStore(models.NewMemoryUserStore()))
+	assert.ErrorContains(t, err, "needs the database")
+
+	c.SessionCleanupInterval = -time.Hour
+	_, err = NewApp(c, WithUserStore(models.NewMemoryUserStore()))
+	assert.ErrorContains(t, err, "SESSION_CLEANUP_INTERVAL must not be negative")
+}
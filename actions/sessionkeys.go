@@ -0,0 +1,141 @@
+package actions
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// minSessionHashKeyLength is the shortest hash key, in bytes, accepted in production.
+	minSessionHashKeyLength = 32
+	// devSessionSecret signs sessions in development and tests when no keys are configured.
+	devSessionSecret = "not-so-super-secret"
+)
+
+// SessionKey is a pair of keys for session cookies: Hash authenticates them and Encryption, if set, encrypts them
+// with AES, so it must be 16, 24 or 32 bytes long.
+type SessionKey struct {
+	Hash       []byte
+	Encryption []byte
+}
+
+// SessionKeys are the keys for session cookies, newest first. Cookies are signed and encrypted with the newest key and
+// accepted if they were made with any of them, so keys can be rotated by adding a new one to the front and retiring
+// the oldest once the sessions it made have expired.
+//
+// In the environment they're a comma separated list of base64 encoded keys, each a hash key optionally followed by a
+// colon and an encryption key, e.g. "<new hash>:<new encryption>,<old hash>:<old encryption>". A pair of suitable keys
+// can be made with "openssl rand -base64 32".
+type SessionKeys []SessionKey
+
+// Decode parses keys from the environment, implementing envconfig.Decoder.
+func (k *SessionKeys) Decode(value string) error {
+	var keys SessionKeys
+	for i, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		hash, encryption, _ := strings.Cut(pair, ":")
+		var key SessionKey
+		var err error
+		if key.Hash, err = base64.StdEncoding.DecodeString(hash); err != nil {
+			return fmt.Errorf("session key %d: could not decode hash key: %w", i+1, err)
+		}
+		if encryption != "" {
+			if key.Encryption, err = base64.StdEncoding.DecodeString(encryption); err != nil {
+				return fmt.Errorf("session key %d: could not decode encryption key: %w", i+1, err)
+			}
+		}
+		keys = append(keys, key)
+	}
+	*k = keys
+	return nil
+}
+
+// Pairs returns the keys as the pairs taken by sessions.NewCookieStore and securecookie.CodecsFromPairs.
+func (k SessionKeys) Pairs() [][]byte {
+	pairs := make([][]byte, 0, 2*len(k))
+	for _, key := range k {
+		pairs = append(pairs, key.Hash, key.Encryption)
+	}
+	return pairs
+}
+
+// CursorSecrets returns secrets for signing pagination cursors, one derived from each hash key, so that cursors aren't
+// signed with a session key itself but still rotate along with them.
+func (k SessionKeys) CursorSecrets() [][]byte {
+	secrets := make([][]byte, 0, len(k))
+	for _, key := range k {
+		mac := hmac.New(sha256.New, key.Hash)
+		mac.Write([]byte("pagination cursors"))
+		secrets = append(secrets, mac.Sum(nil))
+	}
+	return secrets
+}
+
+// Validate checks that there's at least one key and that each key has a usable length. In production it also rejects
+// weak keys: hash keys shorter than minSessionHashKeyLength bytes, the development secret, and keys used twice.
+func (k SessionKeys) Validate(production bool) error {
+	if len(k) == 0 {
+		return errors.New("no session keys")
+	}
+	seen := map[string]bool{}
+	for i, key := range k {
+		if len(key.Hash) == 0 {
+			return fmt.Errorf("session key %d: hash key is empty", i+1)
+		}
+		switch len(key.Encryption) {
+		case 0, 16, 24, 32:
+		default:
+			return fmt.Errorf("session key %d: encryption key is %d bytes, must be 16, 24 or 32", i+1, len(key.Encryption))
+		}
+		if !production {
+			continue
+		}
+		if len(key.Hash) < minSessionHashKeyLength {
+			return fmt.Errorf("session key %d: hash key is %d bytes, must be at least %d in production",
+				i+1, len(key.Hash), minSessionHashKeyLength)
+		}
+		if bytes.Equal(key.Hash, []byte(devSessionSecret)) {
+			return fmt.Errorf("session key %d: hash key is the development secret", i+1)
+		}
+		for _, b := range [][]byte{key.Hash, key.Encryption} {
+			if len(b) == 0 {
+				continue
+			}
+			if seen[string(b)] {
+				return fmt.Errorf("session key %d: key is used more than once", i+1)
+			}
+			seen[string(b)] = true
+		}
+	}
+	return nil
+}
+
+// sessionKeys returns the configured session keys, falling back to SessionSecret as a single hash key for deployments
+// that predate SessionKeys, and outside production to a development secret.
+func (c Config) sessionKeys() (SessionKeys, error) {
+	keys := c.SessionKeys
+	switch {
+	case len(keys) > 0:
+		if c.SessionSecret != "" {
+			return nil, errors.New("only one of SESSION_KEYS and SESSION_SECRET may be set")
+		}
+	case c.SessionSecret != "":
+		keys = SessionKeys{{Hash: []byte(c.SessionSecret)}}
+	case c.DeployEnv.IsProduction():
+		return nil, errors.New("SESSION_KEYS must be set")
+	default:
+		keys = SessionKeys{{Hash: []byte(devSessionSecret)}}
+	}
+	if err := keys.Validate(c.DeployEnv.IsProduction()); err != nil {
+		return nil, fmt.Errorf("invalid session keys: %w", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,128 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionKeysDecode(t *testing.T) {
+	hash := bytes.Repeat([]byte("h"), 32)
+	encryption := bytes.Repeat([]byte("e"), 32)
+	b64 := base64.StdEncoding.EncodeToString
+
+	var keys SessionKeys
+	require.NoError(t, keys.Decode(b64(hash)+":"+b64(encryption)+", "+b64([]byte("old"))))
+	assert.Equal(t, SessionKeys{{Hash: hash, Encryption: encryption}, {Hash: []byte("old")}}, keys)
+	assert.Equal(t, [][]byte{hash, encryption, []byte("old"), nil}, keys.Pairs())
+
+	assert.ErrorContains(t, keys.Decode("not base64!"), "session key 1")
+	assert.ErrorContains(t, keys.Decode(b64(hash)+":"+"not base64!"), "encryption key")
+}
+
+func TestSessionKeysValidate(t *testing.T) {
+	strong := SessionKey{Hash: bytes.Repeat([]byte("h"), 64), Encryption: bytes.Repeat([]byte("e"), 32)}
+	older := SessionKey{Hash: bytes.Repeat([]byte("o"), 32)}
+	tests := []struct {
+		name       string
+		keys       SessionKeys
+		production bool
+		wantErr    string
+	}{
+		{"strong", SessionKeys{strong, older}, true, ""},
+		{"none", nil, false, "no session keys"},
+		{"empty hash", SessionKeys{{Encryption: strong.Encryption}}, false, "hash key is empty"},
+		{"bad encryption length", SessionKeys{{Hash: strong.Hash, Encryption: []byte("short")}}, false, "must be 16, 24 or 32"},
+		{"short hash in development", SessionKeys{{Hash: []byte("short")}}, false, ""},
+		{"short hash in production", SessionKeys{strong, {Hash: []byte("short")}}, true, "session key 2: hash key is 5 bytes"},
+		{"development secret", SessionKeys{{Hash: []byte(devSessionSecret)}}, true, "hash key is"},
+		{"reused key", SessionKeys{strong, {Hash: strong.Encryption}}, true, "used more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.keys.Validate(tt.production)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigSessionKeys(t *testing.T) {
+	keys, err := Config{DeployEnv: DevelopmentEnvironment}.sessionKeys()
+	require.NoError(t, err)
+	assert.Equal(t, SessionKeys{{Hash: []byte(devSessionSecret)}}, keys)
+
+	keys, err = Config{DeployEnv: ProductionEnvironment, SessionSecret: strings.Repeat("s", 32)}.sessionKeys()
+	require.NoError(t, err)
+	assert.Equal(t, SessionKeys{{Hash: []byte(strings.Repeat("s", 32))}}, keys)
+
+	_, err = Config{DeployEnv: ProductionEnvironment}.sessionKeys()
+	assert.ErrorContains(t, err, "SESSION_KEYS must be set")
+	_, err = Config{DeployEnv: ProductionEnvironment, SessionSecret: "password"}.sessionKeys()
+	assert.ErrorContains(t, err, "must be at least 32")
+	_, err = Config{SessionSecret: "secret", SessionKeys: SessionKeys{{Hash: []byte("key")}}}.sessionKeys()
+	assert.ErrorContains(t, err, "only one of")
+}
+
+// TestSessionKeyRotation validates that sessions made with an older key survive a new key being added, are encrypted
+// with the new key from then on, and are dropped once the older key is retired.
+func TestSessionKeyRotation(t *testing.T) {
+	oldKey := SessionKey{Hash: bytes.Repeat([]byte("1"), 32), Encryption: bytes.Repeat([]byte("2"), 32)}
+	newKey := SessionKey{Hash: bytes.Repeat([]byte("3"), 32), Encryption: bytes.Repeat([]byte("4"), 32)}
+
+	// save stores a value in a session with the given keys, returning the cookie.
+	save := func(keys SessionKeys) *http.Cookie {
+		store := sessions.NewCookieStore(keys.Pairs()...)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		s, err := store.New(r, "session")
+		require.NoError(t, err)
+		s.Values["UserEmail"] = "joe.schmoe@example.com"
+		w := httptest.NewRecorder()
+		require.NoError(t, s.Save(r, w))
+		return w.Result().Cookies()[0]
+	}
+	// load returns the value from a session cookie read with the given keys, if it could be read.
+	load := func(keys SessionKeys, c *http.Cookie) any {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(c)
+		s, _ := sessions.NewCookieStore(keys.Pairs()...).New(r, "session")
+		return s.Values["UserEmail"]
+	}
+
+	oldCookie := save(SessionKeys{oldKey})
+	assert.Nil(t, load(SessionKeys{{Hash: oldKey.Hash}}, oldCookie), "cookies are encrypted")
+	assert.Equal(t, "joe.schmoe@example.com", load(SessionKeys{newKey, oldKey}, oldCookie))
+
+	newCookie := save(SessionKeys{newKey, oldKey})
+	assert.Equal(t, "joe.schmoe@example.com", load(SessionKeys{newKey}, newCookie), "made with the newest key")
+	assert.Nil(t, load(SessionKeys{oldKey}, newCookie))
+	assert.Nil(t, load(SessionKeys{newKey}, oldCookie), "the old key is retired")
+}
+
+// TestSessionKeysCursorSecrets validates that cursors are signed with secrets derived from, but not equal to, the session
+// keys, so they survive a new session key being added.
+func TestSessionKeysCursorSecrets(t *testing.T) {
+	oldKey := SessionKey{Hash: bytes.Repeat([]byte("1"), 32)}
+	newKey := SessionKey{Hash: bytes.Repeat([]byte("3"), 32)}
+
+	secrets := SessionKeys{oldKey}.CursorSecrets()
+	require.Len(t, secrets, 1)
+	assert.NotEqual(t, oldKey.Hash, secrets[0])
+
+	cursor := models.NewCursorCodec(secrets...).Encode(models.Cursor{ID: 1, Order: "id asc"})
+	_, err := models.NewCursorCodec(SessionKeys{newKey, oldKey}.CursorSecrets()...).Decode(cursor)
+	assert.NoError(t, err)
+	_, err = models.NewCursorCodec(SessionKeys{newKey}.CursorSecrets()...).Decode(cursor)
+	assert.Error(t, err)
+}
@@ -0,0 +1,255 @@
+package actions
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/katabole/kbexample/models"
+	"github.com/katabole/kbsession"
+)
+
+// tokenLifetimes are the days API tokens can be created to last for on the settings page, 0 meaning forever.
+var tokenLifetimes = []int{7, 30, 90, 365, 0}
+
+// defaultTokenLifetime is how many days API tokens last unless asked otherwise.
+const defaultTokenLifetime = 30
+
+// maxTokenLifetime is the most days an API token can be created to last for.
+const maxTokenLifetime = 3650
+
+type apiTokenKey struct{}
+
+// GetAPIToken returns the API token the request was authenticated with, or nil if it wasn't.
+func GetAPIToken(ctx context.Context) *models.APIToken {
+	t, _ := ctx.Value(apiTokenKey{}).(*models.APIToken)
+	return t
+}
+
+// bearerToken returns the token from the request's "Authorization: Bearer <token>" header, if it has one.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// withAPIToken returns the request logged in as the owner of the API token, with only the permissions they have that
+// are in the token's scopes. It returns an UnauthorizedError if the token isn't valid, or its owner can't log in.
+func (app *App) withAPIToken(r *http.Request, secret string) (*http.Request, error) {
+	token, err := app.users.UseAPIToken(r.Context(), models.HashAPIToken(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &UnauthorizedError{Err: errors.New("invalid or expired API token")}
+	} else if err != nil {
+		return nil, err
+	}
+	user, err := app.users.GetUserByID(r.Context(), token.UserID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (user.Disabled || app.conf.userDenial(user) != "")) {
+		return nil, &UnauthorizedError{Err: errors.New("the API token's user can't log in")}
+	} else if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.userPermissions(r.Context(), user)
+	if err != nil {
+		return nil, err
+	}
+	scoped := Permissions{}
+	for _, scope := range token.Scopes {
+		scoped[scope] = permissions[scope]
+	}
+	r = withPermissions(withCurrentUser(r, user), scoped)
+	return r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)), nil
+}
+
+// tokenForm is a request to create an API token.
+type tokenForm struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is how long the token lasts, or 0 for it to never expire.
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// validate checks the form, given the permissions of the user creating the token, which are all it can have.
+func (f *tokenForm) validate(permissions Permissions) models.ValidationErrors {
+	errs := models.ValidationErrors{}
+	if strings.TrimSpace(f.Name) == "" {
+		errs["name"] = "must not be blank"
+	} else if len(f.Name) > models.MaxNameLength {
+		errs["name"] = fmt.Sprintf("must be at most %d characters", models.MaxNameLength)
+	}
+	if len(f.Scopes) == 0 {
+		errs["scopes"] = "must include at least one permission"
+	}
+	for _, scope := range f.Scopes {
+		if !permissions.Can(scope) {
+			errs["scopes"] = fmt.Sprintf("can't include %s, which you don't have", scope)
+		}
+	}
+	if f.ExpiresInDays < 0 || f.ExpiresInDays > maxTokenLifetime {
+		errs["expires_in_days"] = fmt.Sprintf("must be between 0 (never) and %d", maxTokenLifetime)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// requireSessionForTokens responds with an error, returning false, unless the request is from a user logged in with a
+// session who can have API tokens. Tokens can't manage tokens, or a leaked one could be used to make more.
+func (app *App) requireSessionForTokens(w http.ResponseWriter, r *http.Request) bool {
+	if GetAPIToken(r.Context()) != nil {
+		app.render.Error(w, r, &ForbiddenError{Err: errors.New("API tokens can't be used to manage API tokens")})
+		return false
+	}
+	if GetCurrentUser(r.Context()).ID == 0 {
+		app.render.Error(w, r, &BadRequestError{Err: errors.New("the development stand-in user can't have API tokens, log in to create them")})
+		return false
+	}
+	return true
+}
+
+// renderTokens renders the API token settings page, with the given status and extra data, e.g. a token just created.
+func (app *App) renderTokens(w http.ResponseWriter, r *http.Request, status int, data map[string]any) {
+	tokens, err := app.users.GetUserAPITokens(r.Context(), GetCurrentUser(r.Context()).ID)
+	if err != nil {
+		app.render.Error(w, r, err)
+		return
+	}
+	var scopes []string
+	for p, ok := range GetPermissions(r.Context()) {
+		if ok {
+			scopes = append(scopes, p)
+		}
+	}
+	slices.Sort(scopes)
+
+	data["Tokens"] = tokens
+	data["Scopes"] = scopes
+	data["Lifetimes"] = tokenLifetimes
+	if _, ok := data["Form"]; !ok {
+		data["Form"] = tokenForm{ExpiresInDays: defaultTokenLifetime}
+	}
+	app.render.HTML(w, r, HTMLParams{Status: status, Template: "settings/tokens", Title: "API tokens", Data: data})
+}
+
+// TokensGET handles GET /settings/tokens, listing the user's API tokens.
+func (app *App) TokensGET(w http.ResponseWriter, r *http.Request) {
+	if !app.requireSessionForTokens(w, r) {
+		return
+	}
+	if GetContentType(r) == ContentTypeHTML {
+		app.renderTokens(w, r, http.StatusOK, map[string]any{})
+		return
+	}
+	tokens, err := app.users.GetUserAPITokens(r.Context(), GetCurrentUser(r.Context()).ID)
+	if err != nil {
+		app.render.Error(w, r, err)
+		return
+	}
+	app.render.Encode(w, r, http.StatusOK, tokens)
+}
+
+// TokenPOST handles POST /settings/tokens, creating an API token. The token itself is only ever in this response.
+func (app *App) TokenPOST(w http.ResponseWriter, r *http.Request) {
+	if !app.requireSessionForTokens(w, r) {
+		return
+	}
+
+	var form tokenForm
+	if GetContentType(r) == ContentTypeHTML {
+		if err := r.ParseForm(); err != nil {
+			app.render.Error(w, r, &BadRequestError{Err: err})
+			return
+		}
+		form.Name = r.Form.Get("name")
+		form.Scopes = r.Form["scopes"]
+		if days, err := strconv.Atoi(r.Form.Get("expires_in_days")); err == nil {
+			form.ExpiresInDays = days
+		} else {
+			form.ExpiresInDays = -1
+		}
+	} else {
+		// A token that never expires has to be asked for with 0, leaving it out gets the default.
+		var body struct {
+			tokenForm
+			ExpiresInDays *int `json:"expires_in_days"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			app.render.Error(w, r, &BadRequestError{Err: err})
+			return
+		}
+		form = body.tokenForm
+		form.ExpiresInDays = defaultTokenLifetime
+		if body.ExpiresInDays != nil {
+			form.ExpiresInDays = *body.ExpiresInDays
+		}
+	}
+
+	if errs := form.validate(GetPermissions(r.Context())); len(errs) > 0 {
+		if GetContentType(r) == ContentTypeHTML {
+			app.renderTokens(w, r, http.StatusUnprocessableEntity, map[string]any{"Form": form, "Errors": errs})
+		} else {
+			app.render.Error(w, r, &ValidationError{Fields: errs})
+		}
+		return
+	}
+
+	var expiresAt *time.Time
+	if form.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, form.ExpiresInDays)
+		expiresAt = &t
+	}
+	secret, token := models.NewAPIToken(GetCurrentUser(r.Context()).ID, strings.TrimSpace(form.Name), form.Scopes, expiresAt)
+	token, err := app.users.CreateAPIToken(r.Context(), token)
+	if err != nil {
+		app.render.Error(w, r, err)
+		return
+	}
+
+	if GetContentType(r) == ContentTypeHTML {
+		app.renderTokens(w, r, http.StatusCreated, map[string]any{"NewToken": token, "Secret": secret})
+	} else {
+		app.render.JSON(w, r, http.StatusCreated, struct {
+			*models.APIToken
+			Token string `json:"token"`
+		}{token, secret})
+	}
+}
+
+// TokenDELETE handles DELETE /settings/tokens/{id}, revoking one of the user's API tokens.
+func (app *App) TokenDELETE(w http.ResponseWriter, r *http.Request) {
+	if !app.requireSessionForTokens(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.render.Error(w, r, &BadRequestError{Err: err})
+		return
+	}
+
+	if err := app.users.DeleteAPIToken(r.Context(), GetCurrentUser(r.Context()).ID, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = &NotFoundError{Err: fmt.Errorf("API token ID %d not found", id)}
+		}
+		app.render.Error(w, r, err)
+		return
+	}
+
+	if GetContentType(r) == ContentTypeHTML {
+		kbsession.AddFlash(r, "success", "API token revoked")
+		app.render.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+	} else {
+		app.render.JSON(w, r, http.StatusOK, map[string]string{"message": "API token revoked"})
+	}
+}
@@ -0,0 +1,158 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAPITokens validates creating an API token on the settings page, using it to call the JSON API with only its
+// scopes, and revoking it.
+func TestAPITokens(t *testing.T) {
+	t.Parallel()
+	f := newRBACFixture(t, conf)
+	defer f.Cleanup()
+
+	u, err := f.Users.CreateUser(t.Context(), &models.User{Name: "Ed"})
+	require.NoError(t, err)
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), u.ID, []string{"editor"}))
+	f.Login(u)
+
+	page, err := f.Client.GetPage("/settings/tokens")
+	require.NoError(t, err)
+	assert.Contains(t, page, "No tokens yet")
+	assert.Contains(t, page, `value="users:create"`, "editors can give tokens their permissions")
+	assert.NotContains(t, page, `value="users:delete"`, "but not others")
+
+	_, err = f.Client.PostPage("/settings/tokens", url.Values{"name": {"sneaky"}, "scopes": {"users:delete"}, "expires_in_days": {"30"}})
+	assert.ErrorContains(t, err, "got 422 code")
+
+	page, err = f.Client.PostPage("/settings/tokens", url.Values{"name": {"export script"}, "scopes": {"users:read"}, "expires_in_days": {"30"}})
+	require.NoError(t, err)
+	secret := regexp.MustCompile(models.APITokenPrefix + `[A-Z2-7]+`).FindString(page)
+	require.NotEmpty(t, secret, "the token is shown once")
+	tokens, err := f.Users.GetUserAPITokens(t.Context(), u.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.NotContains(t, string(tokens[0].Hash), secret, "only its hash is stored")
+	require.NotNil(t, tokens[0].ExpiresAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *tokens[0].ExpiresAt, time.Minute)
+
+	// call makes a JSON request without cookies, with the given bearer token, returning the response status.
+	call := func(method, path, token string, body any) int {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		req, err := http.NewRequest(method, f.URL(path), bytes.NewReader(data))
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+		}
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, fmt.Sprintf("/users/%d", u.ID), secret, nil))
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/users", secret, models.User{Name: "Tim"}),
+		"the token's scopes limit it, even though its user can create users")
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/users", secret+"x", nil))
+	assert.Equal(t, http.StatusForbidden, call(http.MethodGet, "/settings/tokens", secret, nil), "tokens can't manage tokens")
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/logout/all", secret, nil), "or log their user out")
+	tokens, err = f.Users.GetUserAPITokens(t.Context(), u.ID)
+	require.NoError(t, err)
+	assert.NotNil(t, tokens[0].LastUsedAt)
+
+	// A bad token is rejected even alongside a valid session, rather than falling back to it.
+	req, err := http.NewRequest(http.MethodGet, "/users", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+models.APITokenPrefix+"wrong")
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Tokens stop working when their user is disabled, or they're revoked.
+	u.Disabled = true
+	require.NoError(t, f.Users.UpdateUser(t.Context(), u))
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/users", secret, nil))
+	u.Disabled = false
+	require.NoError(t, f.Users.UpdateUser(t.Context(), u))
+	f.Login(u)
+	page, err = f.Client.PostPage(fmt.Sprintf("/settings/tokens/%d/delete", tokens[0].ID), nil)
+	require.NoError(t, err)
+	assert.Contains(t, page, "API token revoked")
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/users", secret, nil))
+}
+
+// TestAPITokenSkipsCrossOriginProtection validates that requests with an API token aren't subject to cross-origin
+// protection, which still applies to requests relying on the session cookie.
+func TestAPITokenSkipsCrossOriginProtection(t *testing.T) {
+	t.Parallel()
+	f := newRBACFixture(t, conf)
+	defer f.Cleanup()
+
+	u, err := f.Users.CreateUser(t.Context(), &models.User{Name: "Ed"})
+	require.NoError(t, err)
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), u.ID, []string{"editor"}))
+	secret, token := models.NewAPIToken(u.ID, "script", []string{models.PermissionUsersCreate}, nil)
+	_, err = f.Users.CreateAPIToken(t.Context(), token)
+	require.NoError(t, err)
+	f.Login(u)
+
+	// post creates a user from another site, returning the response status.
+	post := func(token string) int {
+		req, err := http.NewRequest(http.MethodPost, "/users", bytes.NewReader([]byte(`{"name":"Tim"}`)))
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Origin", "https://evil.example.com")
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := f.Client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, post(""), "the session cookie alone is blocked")
+	assert.Equal(t, http.StatusCreated, post(secret))
+}
+
+// TestAPITokenJSONExpiry validates that tokens created with JSON expire after the default lifetime unless they
+// explicitly ask never to.
+func TestAPITokenJSONExpiry(t *testing.T) {
+	t.Parallel()
+	f := newRBACFixture(t, conf)
+	defer f.Cleanup()
+
+	u, err := f.Users.CreateUser(t.Context(), &models.User{Name: "Ed"})
+	require.NoError(t, err)
+	require.NoError(t, f.Users.SetUserRoles(t.Context(), u.ID, []string{"editor"}))
+	f.Login(u)
+
+	var created models.APIToken
+	require.NoError(t, f.Client.PostJSON("/settings/tokens", map[string]any{"name": "a", "scopes": []string{"users:read"}}, &created))
+	require.NotNil(t, created.ExpiresAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, defaultTokenLifetime), *created.ExpiresAt, time.Minute)
+
+	created = models.APIToken{}
+	require.NoError(t, f.Client.PostJSON("/settings/tokens",
+		map[string]any{"name": "b", "scopes": []string{"users:read"}, "expires_in_days": 0}, &created))
+	assert.NotZero(t, created.ID)
+	assert.Nil(t, created.ExpiresAt, "never expires")
+}
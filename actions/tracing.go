@@ -0,0 +1,115 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans started by this package. Until tracing is set up (see setupTracing), the global
+// tracer provider does nothing, so neither do they.
+const tracerName = "github.com/katabole/kbexample/actions"
+
+// setupTracing installs a global OpenTelemetry tracer provider exporting to the configured TraceExporter, and W3C trace
+// context propagation. It returns the provider, to be shut down when the app stops so buffered spans are sent, or nil
+// if tracing isn't configured.
+func setupTracing(ctx context.Context, conf Config) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.TraceExporter {
+	case "":
+		return nil, nil
+	case "otlp":
+		// The endpoint, headers, etc. are configured with the standard OTEL_EXPORTER_OTLP_* environment variables.
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		var f *os.File
+		if f, err = os.OpenFile(conf.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err == nil {
+			var fe *stdouttrace.Exporter
+			if fe, err = stdouttrace.New(stdouttrace.WithWriter(f)); err == nil {
+				exporter = &fileExporter{Exporter: fe, file: f}
+			} else {
+				f.Close()
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, must be otlp, stdout or file", conf.TraceExporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s trace exporter: %w", conf.TraceExporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "kbexample"),
+		attribute.String("deployment.environment.name", string(conf.DeployEnv)),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp, nil
+}
+
+// fileExporter is a stdout exporter writing to a file, which it closes when it's shut down.
+type fileExporter struct {
+	*stdouttrace.Exporter
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	var result error
+	if err := e.Exporter.Shutdown(ctx); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := e.file.Close(); err != nil {
+		result = multierror.Append(result, fmt.Errorf("could not close trace file: %w", err))
+	}
+	return result
+}
+
+// Trace is middleware that starts a server span for each request, continuing the trace from the client's traceparent
+// header if it sent one. The span is named by the chi route pattern once the request has been routed.
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		route := routePattern(r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(attribute.String("http.route", route), attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
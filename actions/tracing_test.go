@@ -0,0 +1,87 @@
+package actions
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useGlobalTracing swaps in the given global tracer provider and propagator for the rest of the test. Tests using it
+// can't run in parallel.
+func useGlobalTracing(t *testing.T, tp trace.TracerProvider) {
+	oldTP, oldProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(oldTP)
+		otel.SetTextMapPropagator(oldProp)
+	})
+}
+
+// TestTrace validates that requests get a server span named by route, continuing the client's trace, with a child span
+// for rendering the page.
+func TestTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	useGlobalTracing(t, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+	_, err := f.Users.CreateUser(t.Context(), &models.User{Name: "Tim"})
+	require.NoError(t, err)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodGet, f.URL("/users/1"), nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		if s.SpanContext().TraceID().String() == traceID {
+			spans[s.Name()] = s
+		}
+	}
+	require.Contains(t, spans, "GET /users/{id}")
+	require.Contains(t, spans, "render users/show")
+	server := spans["GET /users/{id}"]
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, server.SpanContext().SpanID(), spans["render users/show"].Parent().SpanID())
+}
+
+// TestSetupTracing validates the exporter configuration.
+func TestSetupTracing(t *testing.T) {
+	useGlobalTracing(t, otel.GetTracerProvider())
+
+	tp, err := setupTracing(t.Context(), Config{})
+	require.NoError(t, err)
+	assert.Nil(t, tp, "tracing is disabled unless configured")
+
+	_, err = setupTracing(t.Context(), Config{TraceExporter: "carrier-pigeon"})
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	tp, err = setupTracing(t.Context(), Config{TraceExporter: "file", TraceFile: path})
+	require.NoError(t, err)
+	_, span := otel.Tracer(tracerName).Start(t.Context(), "test span")
+	span.End()
+	require.NoError(t, tp.Shutdown(context.Background()))
+
+	traces, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(traces), `"Name":"test span"`)
+}
@@ -1,11 +1,14 @@
 package actions
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
@@ -16,19 +19,75 @@ import (
 
 // UsersGET handles GET /users
 func (app *App) UsersGET(w http.ResponseWriter, r *http.Request) {
-	users, err := app.db.GetUsers()
+	q, err := parseUserQuery(r)
 	if err != nil {
-		app.render.Error(w, r, http.StatusInternalServerError, err)
+		app.render.Error(w, r, &BadRequestError{Err: err})
 		return
 	}
 
+	page, err := app.users.GetUsers(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidQuery) {
+			err = &BadRequestError{Err: err}
+		}
+		app.render.Error(w, r, err)
+		return
+	}
+
+	nextURL, prevURL := pageURL(r, page.NextCursor), pageURL(r, page.PrevCursor)
+	setLinkHeader(w, map[string]string{"next": nextURL, "prev": prevURL})
+
 	if GetContentType(r) == ContentTypeHTML {
-		app.render.HTML(w, r, HTMLParams{Template: "users/list", Data: users})
+		app.render.HTML(w, r, HTMLParams{Template: "users/list", Data: map[string]any{
+			"Users":   page.Items,
+			"Query":   q,
+			"NextURL": nextURL,
+			"PrevURL": prevURL,
+		}})
 	} else {
-		app.render.JSON(w, r, http.StatusOK, map[string]interface{}{"users": users})
+		app.render.Encode(w, r, http.StatusOK, &usersResponse{
+			Users:      page.Items,
+			NextCursor: page.NextCursor,
+			PrevCursor: page.PrevCursor,
+		})
 	}
 }
 
+// usersResponse is a page of users as sent to clients of the data formats, see Renderer.Encode.
+type usersResponse struct {
+	XMLName    xml.Name       `json:"-" xml:"users"`
+	Users      []*models.User `json:"users" xml:"user"`
+	NextCursor string         `json:"next_cursor" xml:"next_cursor,attr,omitempty"`
+	PrevCursor string         `json:"prev_cursor" xml:"prev_cursor,attr,omitempty"`
+}
+
+func (ur *usersResponse) Items() any { return ur.Users }
+
+// parseUserQuery reads the paging, sorting and filtering options for a user listing from the query string.
+func parseUserQuery(r *http.Request) (models.UserQuery, error) {
+	v := r.URL.Query()
+	q := models.UserQuery{Name: v.Get("name")}
+	q.Sort = v.Get("sort")
+	q.Cursor = v.Get("cursor")
+
+	if s := v.Get("page_size"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size <= 0 {
+			return q, fmt.Errorf("invalid page_size %q", s)
+		}
+		q.PageSize = size
+	}
+
+	switch v.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid order %q, must be asc or desc", v.Get("order"))
+	}
+	return q, nil
+}
+
 // UserNewGET handles GET /users/new
 func (app *App) UserNewGET(w http.ResponseWriter, r *http.Request) {
 	app.render.HTML(w, r, HTMLParams{Template: "users/new"})
@@ -39,23 +98,28 @@ func (app *App) UserPOST(w http.ResponseWriter, r *http.Request) {
 	var u models.User
 	if GetContentType(r) == ContentTypeHTML {
 		if err := r.ParseForm(); err != nil {
-			app.render.Error(w, r, http.StatusBadRequest, err)
+			app.render.Error(w, r, &BadRequestError{Err: err})
 			return
 		}
 		if err := formam.Decode(r.Form, &u); err != nil {
-			app.render.Error(w, r, http.StatusBadRequest, err)
+			app.render.Error(w, r, &BadRequestError{Err: err})
 			return
 		}
 	} else {
 		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-			app.render.Error(w, r, http.StatusBadRequest, err)
+			app.render.Error(w, r, &BadRequestError{Err: err})
 			return
 		}
 	}
 
-	newUser, err := app.db.CreateUser(&u)
+	if errs := u.Validate(); len(errs) > 0 {
+		app.renderUserInvalid(w, r, &u, errs, false)
+		return
+	}
+
+	newUser, err := app.users.CreateUser(r.Context(), &u)
 	if err != nil {
-		app.render.Error(w, r, http.StatusInternalServerError, err)
+		app.render.Error(w, r, err)
 		return
 	}
 
@@ -70,9 +134,29 @@ func (app *App) UserPOST(w http.ResponseWriter, r *http.Request) {
 func (app *App) UserGET(w http.ResponseWriter, r *http.Request) {
 	if u := app.getUserHelper(w, r); u != nil {
 		if GetContentType(r) == ContentTypeHTML {
-			app.render.HTML(w, r, HTMLParams{Template: "users/show", Data: u})
+			identities, err := app.users.GetUserIdentities(r.Context(), u.ID)
+			if err != nil {
+				app.render.Error(w, r, err)
+				return
+			}
+			roles, err := app.users.GetUserRoles(r.Context(), u.ID)
+			if err != nil {
+				app.render.Error(w, r, err)
+				return
+			}
+			allRoles, err := app.users.GetRoles(r.Context())
+			if err != nil {
+				app.render.Error(w, r, err)
+				return
+			}
+			app.render.HTML(w, r, HTMLParams{Template: "users/show", Data: map[string]any{
+				"User":       u,
+				"Identities": identities,
+				"Roles":      roles,
+				"AllRoles":   allRoles,
+			}})
 		} else {
-			app.render.JSON(w, r, http.StatusOK, u)
+			app.render.Encode(w, r, http.StatusOK, u)
 		}
 	}
 }
@@ -84,64 +168,134 @@ func (app *App) UserEditGET(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// renderUserInvalid responds to a create or update with invalid fields, either re-rendering the form with the submitted
+// values and inline errors or sending a problem listing the errors by field.
+func (app *App) renderUserInvalid(w http.ResponseWriter, r *http.Request, u *models.User, errs models.ValidationErrors, edit bool) {
+	if GetContentType(r) == ContentTypeHTML {
+		app.render.HTML(w, r, HTMLParams{
+			Status:   http.StatusUnprocessableEntity,
+			Template: "users/new",
+			Data:     map[string]any{"Edit": edit, "User": u, "Errors": errs},
+		})
+	} else {
+		app.render.Error(w, r, &ValidationError{Fields: errs})
+	}
+}
+
 // getUserHelper gets the user, or returns nil in which case it has already sent back an error.
 func (app *App) getUserHelper(w http.ResponseWriter, r *http.Request) *models.User {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		app.render.Error(w, r, http.StatusBadRequest, err)
+		app.render.Error(w, r, &BadRequestError{Err: err})
 		return nil
 	}
 
-	u, err := app.db.GetUserByID(id)
+	u, err := app.users.GetUserByID(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			msg := fmt.Sprintf("User ID %d not found", id)
-			if GetContentType(r) == ContentTypeHTML {
-				app.render.HTML(w, r, HTMLParams{Status: http.StatusNotFound, Template: "users/error", Data: msg})
-			} else {
-				app.render.JSON(w, r, http.StatusNotFound, map[string]string{"message": msg})
-			}
-		} else {
-			app.render.Error(w, r, http.StatusInternalServerError, err)
+			err = &NotFoundError{Err: fmt.Errorf("User ID %d not found", id)}
 		}
+		app.render.Error(w, r, err)
 		return nil
 	}
 	return u
 }
 
-// UserPUT handles PUT /users/{id}
+// userUpdate holds the fields a request to update a user sent, nil for those it left out, which are left unchanged.
+type userUpdate struct {
+	Name     *string `json:"name"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// decodeUserUpdate reads the fields to update from the request body. A form's "disabled" checkbox is sent along with a
+// hidden "false" field, so it's only changed by forms that include the checkbox, and unchecking it is told apart from
+// leaving it out.
+func decodeUserUpdate(r *http.Request) (*userUpdate, error) {
+	var update userUpdate
+	if GetContentType(r) != ContentTypeHTML {
+		return &update, json.NewDecoder(r.Body).Decode(&update)
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	if name, ok := r.Form["name"]; ok && len(name) > 0 {
+		update.Name = &name[0]
+	}
+	if disabled, ok := r.Form["disabled"]; ok {
+		checked := slices.Contains(disabled, "true")
+		update.Disabled = &checked
+	}
+	return &update, nil
+}
+
+// checkCanDisable returns an error unless the current user may disable the given user, or enable them again. Nobody may
+// disable themselves, and changeUsers keeps anyone disabling the last active admin.
+func (app *App) checkCanDisable(r *http.Request, u *models.User, disable bool) error {
+	if !GetPermissions(r.Context()).Can(models.PermissionUsersDisable) {
+		return &ForbiddenError{Err: fmt.Errorf("you need the %s permission to do that", models.PermissionUsersDisable)}
+	}
+	if disable && GetCurrentUser(r.Context()).ID == u.ID {
+		return &ConflictError{Err: errors.New("you can't disable yourself")}
+	}
+	return nil
+}
+
+// changeUsers runs change as a unit of work, failing with a ConflictError if it leaves no active admins where there
+// were some, so there's always someone left who can manage roles. Counting them within the unit of work means
+// concurrent changes can't each remove a different admin.
+func (app *App) changeUsers(ctx context.Context, change func(tx models.UserStore) error) error {
+	return app.users.WithTx(ctx, func(tx models.UserStore) error {
+		before, err := tx.CountActiveRoleUsers(ctx, models.RoleAdmin)
+		if err != nil {
+			return err
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		after, err := tx.CountActiveRoleUsers(ctx, models.RoleAdmin)
+		if err != nil {
+			return err
+		}
+		if before > 0 && after == 0 {
+			return &ConflictError{Err: errors.New("you can't remove the last active admin")}
+		}
+		return nil
+	})
+}
+
+// UserPUT handles PUT /users/{id}, changing only the fields that were sent.
 func (app *App) UserPUT(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	u := app.getUserHelper(w, r)
+	if u == nil {
+		return
+	}
+	update, err := decodeUserUpdate(r)
 	if err != nil {
-		app.render.Error(w, r, http.StatusBadRequest, err)
+		app.render.Error(w, r, &BadRequestError{Err: err})
 		return
 	}
 
-	var u models.User
-	if GetContentType(r) == ContentTypeHTML {
-		if err := r.ParseForm(); err != nil {
-			app.render.Error(w, r, http.StatusBadRequest, err)
-			return
-		}
-		if err := formam.Decode(r.Form, &u); err != nil {
-			app.render.Error(w, r, http.StatusBadRequest, err)
-			return
-		}
-	} else {
-		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-			app.render.Error(w, r, http.StatusBadRequest, err)
+	if update.Name != nil {
+		u.Name = *update.Name
+	}
+	if update.Disabled != nil && *update.Disabled != u.Disabled {
+		if err := app.checkCanDisable(r, u, *update.Disabled); err != nil {
+			app.render.Error(w, r, err)
 			return
 		}
+		u.Disabled = *update.Disabled
+	}
+	if errs := u.Validate(); len(errs) > 0 {
+		app.renderUserInvalid(w, r, u, errs, true)
+		return
 	}
 
-	// Even if they pass an ID in the body, ignore it and use the one from the URL.
-	u.ID = id
-	if err := app.db.UpdateUser(&u); err != nil {
+	err = app.changeUsers(r.Context(), func(tx models.UserStore) error { return tx.UpdateUser(r.Context(), u) })
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			app.render.Error(w, r, http.StatusNotFound, errors.New("user not found"))
-		} else {
-			app.render.Error(w, r, http.StatusInternalServerError, err)
+			err = &NotFoundError{Err: fmt.Errorf("User ID %d not found", u.ID)}
 		}
+		app.render.Error(w, r, err)
 		return
 	}
 
@@ -156,12 +310,17 @@ func (app *App) UserPUT(w http.ResponseWriter, r *http.Request) {
 func (app *App) UserDELETE(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		app.render.Error(w, r, http.StatusBadRequest, err)
+		app.render.Error(w, r, &BadRequestError{Err: err})
 		return
 	}
 
-	if err := app.db.DeleteUser(id); err != nil {
-		app.render.Error(w, r, http.StatusInternalServerError, err)
+	if id == GetCurrentUser(r.Context()).ID {
+		app.render.Error(w, r, &ConflictError{Err: errors.New("you can't delete yourself")})
+		return
+	}
+	err = app.changeUsers(r.Context(), func(tx models.UserStore) error { return tx.DeleteUser(r.Context(), id) })
+	if err != nil {
+		app.render.Error(w, r, err)
 		return
 	}
 
@@ -172,3 +331,62 @@ func (app *App) UserDELETE(w http.ResponseWriter, r *http.Request) {
 		app.render.JSON(w, r, http.StatusOK, map[string]string{"message": "User deleted"})
 	}
 }
+
+// UserRolesPUT handles PUT /users/{id}/roles, replacing the user's roles with those given, as "role" form values or a
+// JSON {"roles": [...]}.
+func (app *App) UserRolesPUT(w http.ResponseWriter, r *http.Request) {
+	u := app.getUserHelper(w, r)
+	if u == nil {
+		return
+	}
+
+	var body struct {
+		Roles []string `json:"roles"`
+	}
+	if GetContentType(r) == ContentTypeHTML {
+		if err := r.ParseForm(); err != nil {
+			app.render.Error(w, r, &BadRequestError{Err: err})
+			return
+		}
+		body.Roles = r.Form["role"]
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			app.render.Error(w, r, &BadRequestError{Err: err})
+			return
+		}
+	}
+
+	if u.ID == GetCurrentUser(r.Context()).ID && !slices.Contains(body.Roles, models.RoleAdmin) {
+		roles, err := app.users.GetUserRoles(r.Context(), u.ID)
+		if err != nil {
+			app.render.Error(w, r, err)
+			return
+		}
+		if slices.Contains(roles, models.RoleAdmin) {
+			app.render.Error(w, r, &ConflictError{Err: errors.New("you can't remove your own admin role")})
+			return
+		}
+	}
+	err := app.changeUsers(r.Context(), func(tx models.UserStore) error {
+		return tx.SetUserRoles(r.Context(), u.ID, body.Roles)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrUnknownRole) {
+			err = &BadRequestError{Err: err}
+		}
+		app.render.Error(w, r, err)
+		return
+	}
+
+	if GetContentType(r) == ContentTypeHTML {
+		kbsession.AddFlash(r, "success", "Roles updated")
+		app.render.Redirect(w, r, fmt.Sprintf("/users/%d", u.ID), http.StatusSeeOther)
+	} else {
+		roles, err := app.users.GetUserRoles(r.Context(), u.ID)
+		if err != nil {
+			app.render.Error(w, r, err)
+			return
+		}
+		app.render.JSON(w, r, http.StatusOK, map[string][]string{"roles": roles})
+	}
+}
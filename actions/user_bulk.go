@@ -0,0 +1,227 @@
+package actions
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/katabole/kbsession"
+)
+
+const (
+	// maxImportSize caps the size of an import upload, in bytes.
+	maxImportSize = 10 << 20
+	// maxImportRows caps the number of users in a single import.
+	maxImportRows = 10000
+	// exportFlushEvery is how many rows are written between flushes of an export to the client.
+	exportFlushEvery = 100
+)
+
+// UsersExportGET handles GET /users/export, streaming every user as CSV (the default) or NDJSON. The format can be
+// chosen with the Accept header or, for links from pages, a format=csv|ndjson query parameter.
+func (app *App) UsersExportGET(w http.ResponseWriter, r *http.Request) {
+	var enc interface {
+		Write(u *models.User) error
+		Flush() error
+	}
+	format := r.URL.Query().Get("format")
+	switch {
+	case format == "ndjson" || (format == "" && GetContentType(r) == ContentTypeNDJSON):
+		w.Header().Set("Content-Type", encoders[ContentTypeNDJSON].MediaType())
+		w.Header().Set("Content-Disposition", `attachment; filename="users.ndjson"`)
+		enc = &ndjsonStream{enc: json.NewEncoder(w), w: w}
+	case format == "csv" || format == "":
+		w.Header().Set("Content-Type", encoders[ContentTypeCSV].MediaType())
+		w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		cw := newCSVWriter(w, reflect.TypeFor[models.User]())
+		if err := cw.WriteHeader(); err != nil {
+			return
+		}
+		enc = &csvStream{cw: cw, w: w}
+	default:
+		app.render.Error(w, r, &BadRequestError{Err: fmt.Errorf("unknown export format %q", format)})
+		return
+	}
+	kbsession.Save(w, r)
+
+	rows := 0
+	err := app.users.EachUser(r.Context(), func(u *models.User) error {
+		if err := enc.Write(u); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushEvery == 0 {
+			return enc.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = enc.Flush()
+	}
+	if err != nil {
+		// The status and some rows have already been sent, so all we can do is cut the response short, letting the
+		// client know it's incomplete.
+		slog.Error("User export failed", "err", err, "rows", rows)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type csvStream struct {
+	cw *csvWriter
+	w  http.ResponseWriter
+}
+
+func (s *csvStream) Write(u *models.User) error { return s.cw.Write(u) }
+
+func (s *csvStream) Flush() error {
+	s.cw.Flush()
+	if err := s.cw.Error(); err != nil {
+		return err
+	}
+	return http.NewResponseController(s.w).Flush()
+}
+
+type ndjsonStream struct {
+	enc *json.Encoder
+	w   http.ResponseWriter
+}
+
+func (s *ndjsonStream) Write(u *models.User) error { return s.enc.Encode(u) }
+func (s *ndjsonStream) Flush() error               { return http.NewResponseController(s.w).Flush() }
+
+// UsersImportGET handles GET /users/import
+func (app *App) UsersImportGET(w http.ResponseWriter, r *http.Request) {
+	app.render.HTML(w, r, HTMLParams{Template: "users/import"})
+}
+
+// importRowError describes why a row of an import was rejected. Rows are numbered from 1, not counting a CSV header.
+type importRowError struct {
+	Row    int                     `json:"row"`
+	Errors models.ValidationErrors `json:"errors"`
+}
+
+// importResponse is the result of an import, with either the number of users created or the reasons it was rejected.
+type importResponse struct {
+	Imported int              `json:"imported"`
+	Errors   []importRowError `json:"errors,omitempty"`
+}
+
+// UsersImportPOST handles POST /users/import. It takes a multipart upload (in the "file" field) of either a CSV file
+// with a "name" column or a JSON array of users. Every row is validated first, and if any are invalid nothing is
+// imported and the errors are reported by row; otherwise all the users are created together.
+func (app *App) UsersImportPOST(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		app.render.Error(w, r, &BadRequestError{Err: fmt.Errorf("could not read uploaded file: %w", err)})
+		return
+	}
+	defer file.Close()
+
+	users, err := parseUserImport(file, header)
+	if err != nil {
+		app.render.Error(w, r, &BadRequestError{Err: err})
+		return
+	}
+	if len(users) > maxImportRows {
+		app.render.Error(w, r, &BadRequestError{Err: fmt.Errorf("too many rows, at most %d can be imported at once", maxImportRows)})
+		return
+	}
+
+	var result importResponse
+	for i, u := range users {
+		if errs := u.Validate(); len(errs) > 0 {
+			result.Errors = append(result.Errors, importRowError{Row: i + 1, Errors: errs})
+		}
+	}
+	if len(result.Errors) > 0 {
+		if GetContentType(r) == ContentTypeHTML {
+			app.render.HTML(w, r, HTMLParams{
+				Status:   http.StatusUnprocessableEntity,
+				Template: "users/import",
+				Data:     result,
+			})
+		} else {
+			app.render.JSON(w, r, http.StatusUnprocessableEntity, result)
+		}
+		return
+	}
+
+	created, err := app.users.CreateUsers(r.Context(), users)
+	if err != nil {
+		app.render.Error(w, r, err)
+		return
+	}
+	result.Imported = len(created)
+
+	if GetContentType(r) == ContentTypeHTML {
+		kbsession.AddFlash(r, "success", fmt.Sprintf("Imported %d users", result.Imported))
+		app.render.Redirect(w, r, "/users", http.StatusSeeOther)
+	} else {
+		app.render.JSON(w, r, http.StatusCreated, result)
+	}
+}
+
+// parseUserImport reads users from an uploaded file, which is JSON if its content type or extension says so or it
+// starts with "[", and CSV otherwise.
+func parseUserImport(file multipart.File, header *multipart.FileHeader) ([]*models.User, error) {
+	br := bufio.NewReader(file)
+	isJSON := strings.HasPrefix(header.Header.Get("Content-Type"), "application/json") ||
+		strings.EqualFold(path.Ext(header.Filename), ".json")
+	if !isJSON {
+		start, _ := br.Peek(64)
+		isJSON = bytes.HasPrefix(bytes.TrimLeft(start, " \t\r\n\ufeff"), []byte("["))
+	}
+
+	if isJSON {
+		var users []*models.User
+		if err := json.NewDecoder(br).Decode(&users); err != nil {
+			return nil, fmt.Errorf("could not parse JSON: %w", err)
+		}
+		for i, u := range users {
+			// Let a null in the array be reported like any other invalid row.
+			if u == nil {
+				users[i] = &models.User{}
+			}
+		}
+		return users, nil
+	}
+
+	cr := csv.NewReader(br)
+	cr.TrimLeadingSpace = true
+	columns, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %w", err)
+	}
+	nameCol := -1
+	for i, col := range columns {
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(col, "\ufeff")), "name") {
+			nameCol = i
+		}
+	}
+	if nameCol < 0 {
+		return nil, errors.New(`CSV has no "name" column`)
+	}
+
+	var users []*models.User
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return users, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse CSV: %w", err)
+		}
+		users = append(users, &models.User{Name: record[nameCol]})
+	}
+}
@@ -0,0 +1,109 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/katabole/kbexample/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// userCSVHeader is the header row of users exported as CSV.
+const userCSVHeader = "id,name,email,avatar_url,disabled,created_at,updated_at,last_login_at\n"
+
+// postImport uploads the given file contents to /users/import, returning the response.
+func postImport(t *testing.T, f *Fixture, filename, contents string) *http.Response {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, err = io.WriteString(fw, contents)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req, err := http.NewRequest(http.MethodPost, "/users/import", &body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+// TestUsersImportExport validates that users imported from CSV and JSON can be exported again in both formats.
+func TestUsersImportExport(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	resp := postImport(t, f, "users.csv", "id,name\n,Alice\n7,\"Smith, Bob\"\n")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var result importResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, 2, result.Imported)
+
+	resp = postImport(t, f, "more", `[{"name": "Charlie"}]`)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	export, err := f.Client.GetPage("/users/export")
+	require.NoError(t, err)
+	records, err := csv.NewReader(strings.NewReader(export)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, userCSVHeader, strings.Join(records[0], ",")+"\n")
+	for i, name := range []string{"Alice", "Smith, Bob", "Charlie"} {
+		assert.Equal(t, []string{strconv.Itoa(i + 1), name}, records[i+1][:2])
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/users/export", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err = f.Client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	dec := json.NewDecoder(resp.Body)
+	var names []string
+	for i := 1; dec.More(); i++ {
+		var u models.User
+		require.NoError(t, dec.Decode(&u))
+		assert.Equal(t, i, u.ID)
+		names = append(names, u.Name)
+	}
+	assert.Equal(t, []string{"Alice", "Smith, Bob", "Charlie"}, names)
+}
+
+// TestUsersImportInvalid validates that an import with any invalid rows reports them all and imports nothing.
+func TestUsersImportInvalid(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	resp := postImport(t, f, "users.json", `[{"name": "Alice"}, {"name": ""}, null]`)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	var result importResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, []importRowError{
+		{Row: 2, Errors: models.ValidationErrors{"name": "must not be blank"}},
+		{Row: 3, Errors: models.ValidationErrors{"name": "must not be blank"}},
+	}, result.Errors)
+
+	resp = postImport(t, f, "users.csv", "email\nalice@example.com\n")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	export, err := f.Client.GetPage("/users/export")
+	require.NoError(t, err)
+	assert.Equal(t, userCSVHeader, export)
+}
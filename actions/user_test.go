@@ -1,8 +1,12 @@
 package actions
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/katabole/kbexample/models"
@@ -12,6 +16,7 @@ import (
 
 // TestUsersBasicJSON validates that we can create, get, update, and delete a user via JSON.
 func TestUsersBasicJSON(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -20,13 +25,16 @@ func TestUsersBasicJSON(t *testing.T) {
 
 	var result models.User
 	require.NoError(t, f.Client.GetJSON(fmt.Sprintf("/users/%d", u.ID), &result))
-	assert.Equal(t, u, result)
+	assert.Equal(t, u.ID, result.ID)
+	assert.Equal(t, u.Name, result.Name)
+	assert.False(t, result.CreatedAt.IsZero())
 
 	u.Name = "Tom"
 	require.NoError(t, f.Client.PutJSON(fmt.Sprintf("/users/%d", u.ID), u, nil))
 
 	require.NoError(t, f.Client.GetJSON(fmt.Sprintf("/users/%d", u.ID), &result))
-	assert.Equal(t, u, result)
+	assert.Equal(t, u.ID, result.ID)
+	assert.Equal(t, u.Name, result.Name)
 
 	require.NoError(t, f.Client.DeleteJSON(fmt.Sprintf("/users/%d", u.ID), nil))
 
@@ -35,6 +43,7 @@ func TestUsersBasicJSON(t *testing.T) {
 
 // TestUsersBasicForm validates that we can create, get, update, and delete a user via html form.
 func TestUsersBasicForm(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
@@ -64,11 +73,169 @@ func TestUsersBasicForm(t *testing.T) {
 	require.Error(t, err)
 }
 
+// TestUserShowAndDisable validates that a user's page shows how they log in, and that they can be disabled with the
+// edit form.
+func TestUserShowAndDisable(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	u, err := f.Users.LoginUser(t.Context(), models.Login{Provider: "google", ProviderUserID: "1", Email: "tim@example.com", Name: "Tim"})
+	require.NoError(t, err)
+	page, err := f.Client.GetPage(fmt.Sprintf("/users/%d", u.ID))
+	require.NoError(t, err)
+	assert.Contains(t, page, "tim@example.com")
+	assert.Contains(t, page, "google")
+	assert.Contains(t, page, "Active")
+
+	_, err = f.Client.PutPage(fmt.Sprintf("/users/%d", u.ID), url.Values{"name": {"Tim"}, "disabled": {"true"}})
+	require.NoError(t, err)
+	got, err := f.Users.GetUserByID(t.Context(), u.ID)
+	require.NoError(t, err)
+	assert.True(t, got.Disabled)
+	assert.Equal(t, "tim@example.com", got.Email, "the email is kept")
+	page, err = f.Client.GetPage(fmt.Sprintf("/users/%d/edit", u.ID))
+	require.NoError(t, err)
+	assert.Contains(t, page, "checked")
+
+	// Updates that leave out disabled don't change it.
+	require.NoError(t, f.Client.PutJSON(fmt.Sprintf("/users/%d", u.ID), map[string]string{"name": "Timothy"}, nil))
+	_, err = f.Client.PutPage(fmt.Sprintf("/users/%d", u.ID), url.Values{"name": {"Timmy"}})
+	require.NoError(t, err)
+	got, err = f.Users.GetUserByID(t.Context(), u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Timmy", got.Name)
+	assert.True(t, got.Disabled)
+
+	// Unchecking the box only sends the hidden field.
+	_, err = f.Client.PutPage(fmt.Sprintf("/users/%d", u.ID), url.Values{"name": {"Tim"}, "disabled": {"false"}})
+	require.NoError(t, err)
+	got, err = f.Users.GetUserByID(t.Context(), u.ID)
+	require.NoError(t, err)
+	assert.False(t, got.Disabled)
+}
+
 func TestLayoutHasUserName(t *testing.T) {
-	f := NewFixture(t)
+	t.Parallel()
+	f := NewMemoryFixture(t)
 	defer f.Cleanup()
 
 	page, err := f.Client.GetPage("/users")
 	require.NoError(t, err)
 	assert.Contains(t, page, "Joe Schmoe")
 }
+
+// TestUsersListPagination validates that the JSON listing pages through users with cursors and Link headers.
+func TestUsersListPagination(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	for _, name := range []string{"Alice", "Bob", "Charlie"} {
+		require.NoError(t, f.Client.PostJSON("/users", models.User{Name: name}, nil))
+	}
+
+	var result struct {
+		Users      []models.User `json:"users"`
+		NextCursor string        `json:"next_cursor"`
+		PrevCursor string        `json:"prev_cursor"`
+	}
+	req, err := http.NewRequest(http.MethodGet, "/users?page_size=2&sort=name&order=desc", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+
+	require.Len(t, result.Users, 2)
+	assert.Equal(t, "Charlie", result.Users[0].Name)
+	assert.Equal(t, "Bob", result.Users[1].Name)
+	assert.Empty(t, result.PrevCursor)
+	require.NotEmpty(t, result.NextCursor)
+	assert.Contains(t, resp.Header.Get("Link"), `rel="next"`)
+	assert.Contains(t, resp.Header.Get("Link"), "cursor="+url.QueryEscape(result.NextCursor))
+
+	require.NoError(t, f.Client.GetJSON("/users?page_size=2&sort=name&order=desc&cursor="+result.NextCursor, &result))
+	require.Len(t, result.Users, 1)
+	assert.Equal(t, "Alice", result.Users[0].Name)
+	assert.Empty(t, result.NextCursor)
+	assert.NotEmpty(t, result.PrevCursor)
+
+	require.Error(t, f.Client.GetJSON("/users?sort=password", &result))
+}
+
+// TestUsersValidation validates that invalid users are rejected with field errors rather than saved.
+func TestUsersValidation(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	req, err := http.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name": "  "}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.Client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	var result struct {
+		Errors map[string]string `json:"errors"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, map[string]string{"name": "must not be blank"}, result.Errors)
+
+	_, err = f.Client.PostPage("/users", url.Values{"name": []string{""}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "422")
+	assert.Contains(t, err.Error(), "Name must not be blank")
+
+	require.NoError(t, f.Client.PostJSON("/users", models.User{Name: "Tim"}, nil))
+	err = f.Client.PutJSON("/users/1", models.User{Name: strings.Repeat("x", models.MaxNameLength+1)}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "422")
+
+	var u models.User
+	require.NoError(t, f.Client.GetJSON("/users/1", &u))
+	assert.Equal(t, "Tim", u.Name)
+}
+
+// TestUsersContentNegotiation validates that users are served in whichever format the Accept header asks for.
+func TestUsersContentNegotiation(t *testing.T) {
+	t.Parallel()
+	f := NewMemoryFixture(t)
+	defer f.Cleanup()
+
+	require.NoError(t, f.Client.PostJSON("/users", models.User{Name: "Tim"}, nil))
+
+	tests := []struct {
+		path        string
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/users", "text/csv", http.StatusOK, "text/csv; charset=UTF-8", userCSVHeader + "1,Tim,,,false,"},
+		{"/users", "application/x-ndjson", http.StatusOK, "application/x-ndjson", `{"id":1,"name":"Tim","email":""`},
+		{"/users/1", "application/xml", http.StatusOK, "application/xml; charset=UTF-8", "<user><id>1</id><name>Tim</name><email></email>"},
+		{"/users/1", "application/pdf", http.StatusNotAcceptable, "application/problem+json; charset=UTF-8", `"status":406`},
+		{"/users/2", "application/xml", http.StatusNotFound, "application/problem+xml; charset=UTF-8", "<status>404</status>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.accept, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.path, nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", tt.accept)
+			resp, err := f.Client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, resp.StatusCode)
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"))
+			assert.Contains(t, string(body), tt.body)
+		})
+	}
+}
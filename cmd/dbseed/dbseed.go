@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/katabole/kbexample/actions"
@@ -25,7 +26,7 @@ func main() {
 		{Name: "Bob"},
 		{Name: "Charlie"},
 	} {
-		if _, err := db.CreateUser(&u); err != nil {
+		if _, err := db.CreateUser(context.Background(), &u); err != nil {
 			log.Fatal(err.Error())
 		}
 	}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,16 +19,45 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	logger, err := actions.NewLogger(os.Stderr, conf.LogFormat, conf.LogLevel)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	slog.SetDefault(logger)
+
 	app, err := actions.NewApp(conf)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	app.Start()
+	if err := app.Start(); err != nil {
+		log.Fatal(err.Error())
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	var serveErr error
+	select {
+	case sig := <-c:
+		log.Printf("Received %s, shutting down (send it again to exit immediately)", sig)
+		go func() {
+			<-c
+			log.Print("Received a second signal, exiting immediately")
+			os.Exit(1)
+		}()
+	case <-app.Done():
+		// The server died on its own, so clean up what's left and make sure whatever runs us knows it failed.
+		serveErr = app.Wait()
+		log.Printf("Server failed: %v", serveErr)
+	}
 
-	app.Stop(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownDrainDelay+conf.ShutdownTimeout)
+	err = app.Stop(ctx)
+	cancel()
+	if err != nil {
+		log.Fatalf("Error shutting down: %v", err)
+	}
+	if serveErr != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,250 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Cursor marks a position in a keyset-paginated listing: the sort key and ID of the row a page continues from.
+type Cursor struct {
+	// Key is the value of the sort column at the row, and ID its primary key which breaks ties between equal keys.
+	Key any `json:"k,omitempty"`
+	ID  int `json:"i"`
+	// Before is set for cursors that page backwards, towards the start of the listing.
+	Before bool `json:"b,omitempty"`
+	// Order identifies the sort order the cursor was issued for, so it can't be replayed against a different one.
+	Order string `json:"o"`
+}
+
+// CursorCodec turns cursors into opaque strings for clients and back. They're signed with an HMAC so clients can't
+// forge them to probe arbitrary sort keys.
+type CursorCodec struct {
+	// secrets sign cursors with the first and accept any, so secrets can be rotated without breaking issued cursors.
+	secrets [][]byte
+}
+
+// NewCursorCodec returns a codec signing with the first of the given secrets and accepting cursors signed with any of
+// them. If there are none a random one is used, which works but means cursors become invalid when the process
+// restarts.
+func NewCursorCodec(secrets ...[]byte) CursorCodec {
+	secrets = slices.DeleteFunc(slices.Clone(secrets), func(s []byte) bool { return len(s) == 0 })
+	if len(secrets) == 0 {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		secrets = [][]byte{secret}
+	}
+	return CursorCodec{secrets: secrets}
+}
+
+// Encode returns the signed, URL-safe form of the cursor.
+func (c CursorCodec) Encode(cur Cursor) string {
+	payload, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signCursor(c.secrets[0], payload))
+}
+
+// Decode verifies and decodes a cursor produced by Encode. Any failure wraps ErrInvalidQuery.
+func (c CursorCodec) Decode(s string) (*Cursor, error) {
+	encPayload, encSig, ok := strings.Cut(s, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !c.verify(payload, sig) {
+		return nil, fmt.Errorf("%w: cursor signature mismatch", ErrInvalidQuery)
+	}
+
+	var cur Cursor
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&cur); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	// Numeric keys come back as json.Number, turn them back into something the driver can bind.
+	if n, ok := cur.Key.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			cur.Key = i
+		} else if f, err := n.Float64(); err == nil {
+			cur.Key = f
+		}
+	}
+	return &cur, nil
+}
+
+// verify reports whether sig is the payload's signature with any of the codec's secrets.
+func (c CursorCodec) verify(payload, sig []byte) bool {
+	return slices.ContainsFunc(c.secrets, func(secret []byte) bool { return hmac.Equal(sig, signCursor(secret, payload)) })
+}
+
+func signCursor(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// PageOptions are the paging and ordering options common to every listing.
+type PageOptions struct {
+	// PageSize is the maximum number of rows to return, defaulting to DefaultPageSize and capped at MaxPageSize.
+	PageSize int
+	// Sort is the field to order by, which each listing maps to a column.
+	Sort string
+	// Desc reverses the sort order.
+	Desc bool
+	// Cursor continues from a page returned by an earlier query with the same sort order and filters.
+	Cursor string
+}
+
+// Page is a single page of results from a keyset-paginated listing.
+type Page[T any] struct {
+	Items []T
+	// NextCursor and PrevCursor are set when there are rows after or before this page.
+	NextCursor string
+	PrevCursor string
+}
+
+// Keyset builds keyset-paginated queries: instead of OFFSET, each page continues with a
+// WHERE (sort_col, id) > ($1, $2) ORDER BY sort_col, id LIMIT n condition, which is stable under concurrent inserts and
+// deletes and as cheap for the last page as the first (given an index on the sort column).
+type Keyset struct {
+	// Select is the query up to its WHERE clause, e.g. "SELECT * FROM users".
+	Select string
+	// Where holds conditions ANDed together to filter rows, with placeholders numbered from $1 and values in Args.
+	Where []string
+	Args  []any
+	// Column is the column to sort by, which must be trusted SQL. Rows with equal values are ordered by "id".
+	Column string
+	Desc   bool
+	// PageSize is the number of rows per page; Build fetches one more to tell whether there's another page.
+	PageSize int
+}
+
+// order is the value stored in Cursor.Order for this keyset.
+func (k Keyset) order() string {
+	if k.Desc {
+		return k.Column + " desc"
+	}
+	return k.Column + " asc"
+}
+
+// Build returns the SQL and args for the page following (or preceding, for a Before cursor) the given cursor, which
+// may be nil for the first page.
+func (k Keyset) Build(cur *Cursor) (string, []any) {
+	where := append([]string(nil), k.Where...)
+	args := append([]any(nil), k.Args...)
+
+	// Paging backwards means walking the index in the opposite direction, the caller flips the results back around.
+	desc := k.Desc != (cur != nil && cur.Before)
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+	if cur != nil {
+		if k.Column == "id" {
+			args = append(args, cur.ID)
+			where = append(where, fmt.Sprintf("id %s $%d", op, len(args)))
+		} else {
+			args = append(args, cur.Key, cur.ID)
+			where = append(where, fmt.Sprintf("(%s, id) %s ($%d, $%d)", k.Column, op, len(args)-1, len(args)))
+		}
+	}
+
+	query := k.Select
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, k.PageSize+1)
+	if k.Column == "id" {
+		query += fmt.Sprintf(" ORDER BY id %s LIMIT $%d", dir, len(args))
+	} else {
+		query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", k.Column, dir, dir, len(args))
+	}
+	return query, args
+}
+
+// withDefaults returns the keyset with its PageSize defaulted and capped.
+func (k Keyset) withDefaults() Keyset {
+	if k.PageSize <= 0 {
+		k.PageSize = DefaultPageSize
+	} else if k.PageSize > MaxPageSize {
+		k.PageSize = MaxPageSize
+	}
+	return k
+}
+
+// decodeCursor decodes a client's cursor, checking it belongs to this keyset's sort order. It returns nil for "".
+func (k Keyset) decodeCursor(codec CursorCodec, cursor string) (*Cursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	cur, err := codec.Decode(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if cur.Order != k.order() {
+		return nil, fmt.Errorf("%w: cursor does not match sort order", ErrInvalidQuery)
+	}
+	return cur, nil
+}
+
+// selectPage runs a keyset-paginated query and returns the page of rows along with cursors for its neighbours. The key
+// function returns a row's sort key and ID, which are stored in those cursors.
+func selectPage[T any](ctx context.Context, q sqlx.QueryerContext, codec CursorCodec, k Keyset, cursor string, key func(T) (any, int)) (*Page[T], error) {
+	k = k.withDefaults()
+	cur, err := k.decodeCursor(codec, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args := k.Build(cur)
+	var items []T
+	if err := sqlx.SelectContext(ctx, q, &items, query, args...); err != nil {
+		return nil, err
+	}
+	return newPage(codec, k, cur, items, key), nil
+}
+
+// newPage turns the rows fetched for a keyset query (up to PageSize+1 of them, in the order walked from the cursor) into
+// a page with cursors for its neighbours.
+func newPage[T any](codec CursorCodec, k Keyset, cur *Cursor, items []T, key func(T) (any, int)) *Page[T] {
+	backward := cur != nil && cur.Before
+	hasMore := len(items) > k.PageSize
+	if hasMore {
+		items = items[:k.PageSize]
+	}
+	if backward {
+		slices.Reverse(items)
+	}
+
+	page := &Page[T]{Items: items}
+	if len(items) == 0 {
+		return page
+	}
+	cursorAt := func(item T, before bool) string {
+		sortKey, id := key(item)
+		if k.Column == "id" {
+			sortKey = nil
+		}
+		return codec.Encode(Cursor{Key: sortKey, ID: id, Before: before, Order: k.order()})
+	}
+	if hasMore || backward {
+		page.NextCursor = cursorAt(items[len(items)-1], false)
+	}
+	if (hasMore && backward) || (cur != nil && !backward) {
+		page.PrevCursor = cursorAt(items[0], true)
+	}
+	return page
+}
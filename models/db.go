@@ -1,10 +1,21 @@
 package models
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"math/rand/v2"
+	"time"
 
+	"github.com/hashicorp/go-multierror"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -14,11 +25,26 @@ type Config struct {
 	Host     string `envconfig:"HOST"`
 	Port     int    `envconfig:"PORT"`
 	SSLMode  string `envconfig:"SSL_MODE"`
+
+	// Schema is the Postgres schema holding our tables, if not the default (public). Tests use it to get a schema each.
+	Schema string `envconfig:"SCHEMA"`
+
+	// QueryTimeout bounds how long each query may run unless the caller's context has an earlier deadline. Zero means
+	// no limit.
+	QueryTimeout time.Duration `envconfig:"QUERY_TIMEOUT" default:"10s"`
+
+	// CursorSecrets sign pagination cursors, newest first (see NewCursorCodec). They aren't read from the environment,
+	// the app derives them from its session keys so they rotate together.
+	CursorSecrets [][]byte `ignored:"true"`
 }
 
 func (c Config) ConnectionString() string {
-	return fmt.Sprintf("dbname=%s user=%s password=%s host=%s port=%d",
+	s := fmt.Sprintf("dbname=%s user=%s password=%s host=%s port=%d",
 		c.DBName, c.User, c.Password, c.Host, c.Port)
+	if c.Schema != "" {
+		s += " search_path=" + c.Schema
+	}
+	return s
 }
 
 func (c Config) URL() string {
@@ -26,18 +52,144 @@ func (c Config) URL() string {
 		c.User, c.Password, c.Host, c.Port, c.DBName, c.SSLMode)
 }
 
+// maxTxAttempts is how many times InTx runs a transaction that keeps failing to serialize.
+const maxTxAttempts = 5
+
+// Postgres error codes (SQLSTATE) for transactions that failed due to concurrent ones, and may succeed if retried.
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+)
+
+// queries holds the repository methods (GetUsers, CreateUser, etc.), which DB and Tx share so that they run the same
+// way on the connection pool or within a transaction.
+type queries struct {
+	ext     sqlx.ExtContext
+	conf    Config
+	cursors CursorCodec
+}
+
 type DB struct {
-	conf Config
+	queries
 
 	*sqlx.DB
 }
 
+// Tx is a transaction started by DB.InTx, offering the same repository methods as DB.
+type Tx struct {
+	queries
+}
+
 func NewDB(conf Config) (*DB, error) {
 	db, err := sqlx.Connect("pgx", conf.ConnectionString())
 	if err != nil {
 		return nil, err
 	}
-	return &DB{conf: conf, DB: db}, nil
+	return &DB{
+		queries: queries{ext: db, conf: conf, cursors: NewCursorCodec(conf.CursorSecrets...)},
+		DB:      db,
+	}, nil
+}
+
+// tracerName identifies the spans started for queries, which do nothing unless the app has set up OpenTelemetry
+// tracing.
+const tracerName = "github.com/katabole/kbexample/models"
+
+// startQuery starts a span for the named query, e.g. "GetUsers", and bounds its context by the configured QueryTimeout.
+// Always call the returned end function, with a pointer to the query's error so a failure is recorded on the span,
+// typically by naming the error result and deferring end(&err).
+func (q *queries) startQuery(ctx context.Context, name string) (context.Context, func(*error)) {
+	ctx, span := q.startSpan(ctx, name)
+	cancel := context.CancelFunc(func() {})
+	if q.conf.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, q.conf.QueryTimeout)
+	}
+	return ctx, func(errp *error) {
+		cancel()
+		endSpan(span, errp)
+	}
+}
+
+// startSpan starts a span for the named query without bounding its context, for queries that may run long.
+func (q *queries) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system.name", "postgresql"),
+		attribute.String("db.namespace", q.conf.DBName),
+		attribute.String("db.operation.name", name),
+	))
+}
+
+// endSpan ends a query's span, first marking it failed if *errp is an error. Finding no rows isn't a failure, callers
+// expect it, e.g. when looking up a user that doesn't exist.
+func endSpan(span trace.Span, errp *error) {
+	if err := *errp; err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InTx runs fn as a unit of work in a SERIALIZABLE transaction, committing if it returns nil and rolling back if it
+// returns an error or panics. When the transaction fails because it conflicted with a concurrent one, it's retried
+// from the start a few times, so fn may run more than once and shouldn't have side effects outside the database.
+func (db *DB) InTx(ctx context.Context, fn func(tx *Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := db.runTx(ctx, fn)
+		if err == nil || attempt == maxTxAttempts || !isSerializationFailure(err) {
+			return err
+		}
+
+		// Back off a little, with jitter, so the conflicting transactions don't just collide again.
+		backoff := time.Duration(attempt*attempt)*10*time.Millisecond + rand.N(10*time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// WithTx runs fn in a transaction with InTx, implementing UserStore.
+func (db *DB) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	return db.InTx(ctx, func(tx *Tx) error { return fn(tx) })
+}
+
+// WithTx runs fn as part of the transaction, which is already a unit of work, implementing UserStore.
+func (tx *Tx) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	return fn(tx)
+}
+
+func (db *DB) runTx(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	sqlTx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	tx := &Tx{queries: queries{ext: sqlTx, conf: db.conf, cursors: db.cursors}}
+
+	defer func() {
+		if p := recover(); p != nil {
+			sqlTx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if rbErr := sqlTx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			return multierror.Append(err, fmt.Errorf("could not roll back transaction: %w", rbErr))
+		}
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// isSerializationFailure reports whether err means a transaction lost a race with a concurrent one and may succeed if
+// tried again.
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == sqlStateSerializationFailure || pgErr.Code == sqlStateDeadlockDetected
+	}
+	return false
 }
 
 func (db *DB) Close() error {
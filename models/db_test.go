@@ -1,15 +1,24 @@
 package models
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"log"
 	"os"
 	"testing"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/joho/godotenv"
+	"github.com/katabole/kbexample/models/dbtest"
 	"github.com/katabole/kbsql"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var conf Config
@@ -23,10 +32,9 @@ func TestMain(m *testing.M) {
 		log.Fatalf("Error loading app config from environment: %v", err)
 	}
 
-	atlasDevDBConf := conf
-	atlasDevDBConf.DBName = "atlas_dev"
-	if err := kbsql.AtlasSetupDB(conf.URL(), atlasDevDBConf.URL()); err != nil {
-		log.Fatalf("Error setting up database: %v", err)
+	// Each test gets its own schema in this database (see NewFixture), so it only needs to exist.
+	if err := kbsql.PostgresCreateDBIfNotExistsByURL(conf.URL()); err != nil {
+		log.Fatalf("Error creating database %s: %v", conf.URL(), err)
 	}
 
 	os.Exit(m.Run())
@@ -37,11 +45,13 @@ type Fixture struct {
 	db *DB
 }
 
-// Setup starts a local test server and returns it along with a cleanup function that should be deferred.
+// NewFixture connects to a fresh schema of the test database, isolated from other tests so they can run in parallel,
+// and returns it along with a cleanup function that should be deferred.
 func NewFixture(t *testing.T) *Fixture {
-	db, err := NewDB(conf)
+	c := conf
+	c.Schema = dbtest.NewSchema(t, conf.URL())
+	db, err := NewDB(c)
 	require.NoError(t, err)
-	require.NoError(t, kbsql.PostgresCleanDB(db.DB))
 
 	return &Fixture{
 		t:  t,
@@ -52,3 +62,111 @@ func NewFixture(t *testing.T) *Fixture {
 func (f *Fixture) Cleanup() {
 	assert.NoError(f.t, f.db.Close())
 }
+
+// TestInTx validates that a transaction's changes are committed together or not at all.
+func TestInTx(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	require.NoError(t, f.db.InTx(t.Context(), func(tx *Tx) error {
+		u, err := tx.CreateUser(t.Context(), &User{Name: "Tim"})
+		if err != nil {
+			return err
+		}
+		u.Name = "Tom"
+		return tx.UpdateUser(t.Context(), u)
+	}))
+	u, err := f.db.GetUserByID(t.Context(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Tom", u.Name)
+
+	failure := errors.New("failure")
+	err = f.db.InTx(t.Context(), func(tx *Tx) error {
+		if _, err := tx.CreateUser(t.Context(), &User{Name: "Alice"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+
+	assert.Panics(t, func() {
+		f.db.InTx(t.Context(), func(tx *Tx) error {
+			if _, err := tx.CreateUser(t.Context(), &User{Name: "Bob"}); err != nil {
+				return err
+			}
+			panic("oops")
+		})
+	})
+
+	page, err := f.db.GetUsers(t.Context(), UserQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	assert.Equal(t, "Tom", page.Items[0].Name)
+}
+
+// TestInTxRetriesSerializationFailures validates that transactions failing to serialize are retried, but others aren't.
+func TestInTxRetriesSerializationFailures(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	attempts := 0
+	require.NoError(t, f.db.InTx(t.Context(), func(tx *Tx) error {
+		attempts++
+		if attempts < 3 {
+			return &pgconn.PgError{Code: sqlStateSerializationFailure}
+		}
+		return nil
+	}))
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err := f.db.InTx(t.Context(), func(tx *Tx) error {
+		attempts++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	attempts = 0
+	err = f.db.InTx(t.Context(), func(tx *Tx) error {
+		attempts++
+		return &pgconn.PgError{Code: sqlStateDeadlockDetected}
+	})
+	assert.True(t, isSerializationFailure(err))
+	assert.Equal(t, maxTxAttempts, attempts)
+}
+
+// TestQuerySpans validates that queries are traced once OpenTelemetry is set up. It swaps the global tracer provider,
+// so it can't run in parallel.
+func TestQuerySpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(old)
+
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	_, err := f.db.CreateUser(t.Context(), &User{Name: "Tim"})
+	require.NoError(t, err)
+	_, err = f.db.GetUserByID(t.Context(), 1)
+	require.NoError(t, err)
+	_, err = f.db.GetUserByID(t.Context(), 12345)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	canceled, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = f.db.GetUserByID(canceled, 1)
+	require.Error(t, err)
+
+	var names []string
+	var statuses []codes.Code
+	for _, s := range recorder.Ended() {
+		names = append(names, s.Name())
+		statuses = append(statuses, s.Status().Code)
+	}
+	assert.Equal(t, []string{"CreateUser", "GetUserByID", "GetUserByID", "GetUserByID"}, names)
+	assert.Equal(t, []codes.Code{codes.Unset, codes.Unset, codes.Unset, codes.Error}, statuses,
+		"failed queries are errors, but finding nothing isn't")
+}
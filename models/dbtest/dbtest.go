@@ -0,0 +1,58 @@
+// Package dbtest gives each test its own Postgres schema, so tests sharing a database can run in parallel without
+// seeing each other's data.
+package dbtest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NewSchema creates a uniquely named schema in the database at dbURL, creates our tables in it from schema.sql, and
+// returns its name. The schema is dropped along with everything in it when the test finishes. Use it by connecting with
+// the schema as the search_path, e.g. via models.Config.Schema.
+func NewSchema(t testing.TB, dbURL string) string {
+	schemaSQL, err := os.ReadFile(schemaPath())
+	require.NoError(t, err)
+
+	db, err := sql.Open("pgx", dbURL)
+	require.NoError(t, err)
+
+	name := "test_" + strings.ToLower(rand.Text())
+	ident := pgx.Identifier{name}.Sanitize()
+	t.Cleanup(func() {
+		_, err := db.ExecContext(context.Background(), "DROP SCHEMA IF EXISTS "+ident+" CASCADE")
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+	})
+
+	tx, err := db.BeginTx(t.Context(), nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.ExecContext(t.Context(), "CREATE SCHEMA "+ident)
+	require.NoError(t, err)
+	_, err = tx.ExecContext(t.Context(), "SET LOCAL search_path TO "+ident)
+	require.NoError(t, err)
+	// Without arguments this is sent as a simple query, so the file may hold many statements.
+	_, err = tx.ExecContext(t.Context(), string(schemaSQL))
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	return name
+}
+
+// schemaPath returns the path of schema.sql at the root of the repo, wherever the tests are run from.
+func schemaPath() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "schema.sql")
+}
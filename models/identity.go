@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrUserDisabled is returned by LoginUser when the user who logged in has been disabled.
+var ErrUserDisabled = errors.New("user is disabled")
+
+// Identity links a user to their account with an identity provider, e.g. Google, so they can log in with it. A user
+// may have identities with several providers.
+type Identity struct {
+	Provider       string    `db:"provider" json:"provider" xml:"provider"`
+	ProviderUserID string    `db:"provider_user_id" json:"provider_user_id" xml:"provider_user_id"`
+	UserID         int       `db:"user_id" json:"user_id" xml:"user_id"`
+	Email          string    `db:"email" json:"email" xml:"email"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at" xml:"created_at"`
+}
+
+// Login is someone's successful authentication with an identity provider, as given to LoginUser.
+//
+// The user it's for is the one with its identity or, failing that, the one with its email, who's then linked to the
+// identity. So the provider must have verified the email, or anyone could log in as anyone else. Failing both, a new
+// user is created. Either way the user's email and avatar are filled in from the login if they don't have them, and
+// their last login time is set, unless they're disabled in which case ErrUserDisabled is returned.
+type Login struct {
+	Provider       string
+	ProviderUserID string
+	Email          string
+	Name           string
+	AvatarURL      string
+}
+
+// displayName is the name for a user created by the login, which falls back to their email if the provider didn't
+// give a name.
+func (l Login) displayName() string {
+	if strings.TrimSpace(l.Name) != "" {
+		return l.Name
+	}
+	return l.Email
+}
+
+// LoginUser runs the login's queries in a transaction, so concurrent first logins can't create the user twice.
+func (db *DB) LoginUser(ctx context.Context, login Login) (*User, error) {
+	var user *User
+	err := db.InTx(ctx, func(tx *Tx) error {
+		var err error
+		user, err = tx.LoginUser(ctx, login)
+		return err
+	})
+	return user, err
+}
+
+func (q *queries) LoginUser(ctx context.Context, login Login) (_ *User, err error) {
+	ctx, end := q.startQuery(ctx, "LoginUser")
+	defer end(&err)
+
+	var user User
+	err = sqlx.GetContext(ctx, q.ext, &user, `SELECT users.* FROM users
+		JOIN identities ON identities.user_id = users.id
+		WHERE identities.provider=$1 AND identities.provider_user_id=$2`, login.Provider, login.ProviderUserID)
+	linked := err == nil
+	if errors.Is(err, sql.ErrNoRows) && login.Email != "" {
+		err = sqlx.GetContext(ctx, q.ext, &user, "SELECT * FROM users WHERE lower(email)=lower($1)", login.Email)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = sqlx.GetContext(ctx, q.ext, &user, "INSERT INTO users (name, email, avatar_url) VALUES ($1, $2, $3) RETURNING *",
+			login.displayName(), login.Email, login.AvatarURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	if !linked {
+		_, err = q.ext.ExecContext(ctx, `INSERT INTO identities (provider, provider_user_id, user_id, email)
+			VALUES ($1, $2, $3, $4)`, login.Provider, login.ProviderUserID, user.ID, login.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fill in the email unless another user has it, which may happen if this identity was linked before they had one.
+	err = sqlx.GetContext(ctx, q.ext, &user, `UPDATE users SET
+			email = CASE
+				WHEN email = '' AND NOT EXISTS (SELECT 1 FROM users WHERE lower(email)=lower($2)) THEN $2
+				ELSE email END,
+			avatar_url = CASE WHEN avatar_url = '' THEN $3 ELSE avatar_url END,
+			last_login_at = now()
+		WHERE id=$1 RETURNING *`, user.ID, login.Email, login.AvatarURL)
+	return &user, err
+}
+
+// GetUserIdentities returns the identities the user can log in with, oldest first.
+func (q *queries) GetUserIdentities(ctx context.Context, userID int) (_ []*Identity, err error) {
+	ctx, end := q.startQuery(ctx, "GetUserIdentities")
+	defer end(&err)
+
+	identities := []*Identity{}
+	err = sqlx.SelectContext(ctx, q.ext, &identities,
+		"SELECT * FROM identities WHERE user_id=$1 ORDER BY created_at, provider", userID)
+	return identities, err
+}
@@ -0,0 +1,508 @@
+package models
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryUserStore is an in-memory UserStore for tests, with the same behavior as the database: IDs are assigned in
+// increasing order starting at 1, missing users give sql.ErrNoRows, and listings page the same way. It's safe for
+// concurrent use. Name ordering compares bytes, which may differ from the database's collation for non-ASCII names.
+type MemoryUserStore struct {
+	mu         sync.RWMutex
+	users      map[int]User
+	identities map[identityKey]Identity
+	// roles maps role names to their permissions, and userRoles user IDs to their role names.
+	roles     map[string]Role
+	userRoles map[int][]string
+	// tokens maps API token IDs to the tokens.
+	tokens      map[int]APIToken
+	nextID      int
+	nextTokenID int
+	cursors     CursorCodec
+}
+
+// identityKey identifies an identity, like the primary key of the identities table.
+type identityKey struct {
+	provider, providerUserID string
+}
+
+var _ UserStore = (*MemoryUserStore)(nil)
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:       map[int]User{},
+		identities:  map[identityKey]Identity{},
+		roles:       map[string]Role{},
+		userRoles:   map[int][]string{},
+		tokens:      map[int]APIToken{},
+		nextID:      1,
+		nextTokenID: 1,
+		cursors:     NewCursorCodec(),
+	}
+}
+
+// WithTx runs fn against a copy of the store, keeping its changes only if it returns nil. Other use of the store waits
+// until it's done, so units of work are serialized.
+func (s *MemoryUserStore) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &MemoryUserStore{
+		users:       maps.Clone(s.users),
+		identities:  maps.Clone(s.identities),
+		roles:       maps.Clone(s.roles),
+		userRoles:   maps.Clone(s.userRoles),
+		tokens:      maps.Clone(s.tokens),
+		nextID:      s.nextID,
+		nextTokenID: s.nextTokenID,
+		cursors:     s.cursors,
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.users, s.identities, s.roles, s.userRoles, s.tokens = tx.users, tx.identities, tx.roles, tx.userRoles, tx.tokens
+	s.nextID, s.nextTokenID = tx.nextID, tx.nextTokenID
+	return nil
+}
+
+func (s *MemoryUserStore) GetUsers(ctx context.Context, query UserQuery) (*Page[*User], error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if query.Sort == "" {
+		query.Sort = "id"
+	}
+	col, ok := userSortColumns[query.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort field %q", ErrInvalidQuery, query.Sort)
+	}
+	k := Keyset{Column: col, Desc: query.Desc, PageSize: query.PageSize}.withDefaults()
+	cur, err := k.decodeCursor(s.cursors, query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the users in the same direction the database query would, starting after the cursor.
+	compare := func(a, b *User) int { return compareUsers(col, a, b) }
+	if k.Desc != (cur != nil && cur.Before) {
+		compare = func(a, b *User) int { return -compareUsers(col, a, b) }
+	}
+	var from *User
+	if cur != nil {
+		from = &User{ID: cur.ID}
+		from.Name, _ = cur.Key.(string)
+	}
+
+	s.mu.RLock()
+	var items []*User
+	for _, u := range s.users {
+		if query.Name != "" && !strings.Contains(strings.ToLower(u.Name), strings.ToLower(query.Name)) {
+			continue
+		}
+		if from != nil && compare(&u, from) <= 0 {
+			continue
+		}
+		items = append(items, &u)
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(items, compare)
+	if len(items) > k.PageSize+1 {
+		items = items[:k.PageSize+1]
+	}
+	return newPage(s.cursors, k, cur, items, func(u *User) (any, int) { return u.Name, u.ID }), nil
+}
+
+// compareUsers orders users by the given sort column, then by ID, like the database query.
+func compareUsers(col string, a, b *User) int {
+	if col == "name" {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.ID, b.ID)
+}
+
+func (s *MemoryUserStore) CreateUser(ctx context.Context, u *User) (*User, error) {
+	users, err := s.CreateUsers(ctx, []*User{u})
+	if err != nil {
+		return nil, err
+	}
+	return users[0], nil
+}
+
+func (s *MemoryUserStore) CreateUsers(ctx context.Context, us []*User) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created := make([]*User, len(us))
+	for i, u := range us {
+		user := s.createUser(User{Name: u.Name})
+		created[i] = &user
+	}
+	return created, nil
+}
+
+// createUser stores a new user with the next ID, as the database would fill in the ID and timestamps. The caller
+// must hold the write lock.
+func (s *MemoryUserStore) createUser(u User) User {
+	now := time.Now()
+	u.ID, u.CreatedAt, u.UpdatedAt = s.nextID, now, now
+	s.nextID++
+	s.users[u.ID] = u
+	return u
+}
+
+func (s *MemoryUserStore) EachUser(ctx context.Context, fn func(*User) error) error {
+	s.mu.RLock()
+	ids := make([]int, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.mu.RLock()
+		u, ok := s.users[id]
+		s.mu.RUnlock()
+		// Like a database cursor would, skip users deleted since we started.
+		if !ok {
+			continue
+		}
+		if err := fn(&u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return &User{}, sql.ErrNoRows
+	}
+	return &u, nil
+}
+
+func (s *MemoryUserStore) UpdateUser(ctx context.Context, u *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[u.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.Name, user.Disabled, user.UpdatedAt = u.Name, u.Disabled, time.Now()
+	s.users[u.ID] = user
+	return nil
+}
+
+func (s *MemoryUserStore) DeleteUser(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, id)
+	delete(s.userRoles, id)
+	for tokenID, token := range s.tokens {
+		if token.UserID == id {
+			delete(s.tokens, tokenID)
+		}
+	}
+	for k, identity := range s.identities {
+		if identity.UserID == id {
+			delete(s.identities, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) LoginUser(ctx context.Context, login Login) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := identityKey{login.Provider, login.ProviderUserID}
+	identity, linked := s.identities[key]
+	user, found := s.users[identity.UserID]
+	if !linked && login.Email != "" {
+		user, found = s.userByEmail(login.Email)
+	}
+	if !found {
+		user = s.createUser(User{Name: login.displayName(), Email: login.Email, AvatarURL: login.AvatarURL})
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	if !linked {
+		s.identities[key] = Identity{
+			Provider:       login.Provider,
+			ProviderUserID: login.ProviderUserID,
+			UserID:         user.ID,
+			Email:          login.Email,
+			CreatedAt:      time.Now(),
+		}
+	}
+	if _, taken := s.userByEmail(login.Email); user.Email == "" && !taken {
+		user.Email = login.Email
+	}
+	if user.AvatarURL == "" {
+		user.AvatarURL = login.AvatarURL
+	}
+	now := time.Now()
+	user.LastLoginAt = &now
+	s.users[user.ID] = user
+	return &user, nil
+}
+
+// userByEmail finds the user with the given email, ignoring case. The caller must hold the lock.
+func (s *MemoryUserStore) userByEmail(email string) (User, bool) {
+	for _, u := range s.users {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+func (s *MemoryUserStore) GetUserIdentities(ctx context.Context, userID int) ([]*Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	identities := []*Identity{}
+	for _, identity := range s.identities {
+		if identity.UserID == userID {
+			identities = append(identities, &identity)
+		}
+	}
+	slices.SortFunc(identities, func(a, b *Identity) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.Provider, b.Provider))
+	})
+	return identities, nil
+}
+
+func (s *MemoryUserStore) EnsureRoles(ctx context.Context, roles []Role) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, role := range roles {
+		existing, ok := s.roles[role.Name]
+		if !ok {
+			existing = Role{Name: role.Name, Description: role.Description}
+		}
+		existing.Permissions = slices.Clone(existing.Permissions)
+		for _, p := range role.Permissions {
+			if !slices.Contains(existing.Permissions, p) {
+				existing.Permissions = append(existing.Permissions, p)
+			}
+		}
+		slices.Sort(existing.Permissions)
+		s.roles[role.Name] = existing
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) GetRoles(ctx context.Context) ([]*Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	roles := []*Role{}
+	for _, role := range s.roles {
+		role.Permissions = slices.Clone(role.Permissions)
+		roles = append(roles, &role)
+	}
+	slices.SortFunc(roles, func(a, b *Role) int { return strings.Compare(a.Name, b.Name) })
+	return roles, nil
+}
+
+func (s *MemoryUserStore) GetUserRoles(ctx context.Context, userID int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{}, s.userRoles[userID]...), nil
+}
+
+func (s *MemoryUserStore) SetUserRoles(ctx context.Context, userID int, roles []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, role := range roles {
+		if _, ok := s.roles[role]; !ok {
+			return fmt.Errorf("%w %q", ErrUnknownRole, role)
+		}
+	}
+	roles = slices.Clone(roles)
+	slices.Sort(roles)
+	s.userRoles[userID] = slices.Compact(roles)
+	return nil
+}
+
+func (s *MemoryUserStore) GetRolePermissions(ctx context.Context, roles []string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	permissions := []string{}
+	for _, role := range roles {
+		permissions = append(permissions, s.roles[role].Permissions...)
+	}
+	slices.Sort(permissions)
+	return slices.Compact(permissions), nil
+}
+
+func (s *MemoryUserStore) GrantFirstRole(ctx context.Context, userID int, role string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.roles[role]; !ok {
+		return false, fmt.Errorf("%w %q", ErrUnknownRole, role)
+	}
+	for _, roles := range s.userRoles {
+		if slices.Contains(roles, role) {
+			return false, nil
+		}
+	}
+	roles := append(slices.Clone(s.userRoles[userID]), role)
+	slices.Sort(roles)
+	s.userRoles[userID] = roles
+	return true, nil
+}
+
+func (s *MemoryUserStore) CountActiveRoleUsers(ctx context.Context, role string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for id, roles := range s.userRoles {
+		if slices.Contains(roles, role) && !s.users[id].Disabled {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryUserStore) CreateAPIToken(ctx context.Context, t *APIToken) (*APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[t.UserID]; !ok {
+		return nil, fmt.Errorf("no user %d to create an API token for", t.UserID)
+	}
+	token := *t
+	token.ID, token.CreatedAt, token.LastUsedAt = s.nextTokenID, time.Now(), nil
+	token.Scopes = slices.Clone(t.Scopes)
+	s.nextTokenID++
+	s.tokens[token.ID] = token
+	return &token, nil
+}
+
+func (s *MemoryUserStore) GetUserAPITokens(ctx context.Context, userID int) ([]*APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := []*APIToken{}
+	for _, token := range s.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, &token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b *APIToken) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(b.ID, a.ID))
+	})
+	return tokens, nil
+}
+
+func (s *MemoryUserStore) UseAPIToken(ctx context.Context, hash []byte) (*APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, token := range s.tokens {
+		if !bytes.Equal(token.Hash, hash) || token.Expired() {
+			continue
+		}
+		now := time.Now()
+		token.LastUsedAt = &now
+		s.tokens[id] = token
+		return &token, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *MemoryUserStore) DeleteAPIToken(ctx context.Context, userID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token, ok := s.tokens[id]; !ok || token.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(s.tokens, id)
+	return nil
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrUnknownRole is returned (wrapped) when given a role that doesn't exist.
+var ErrUnknownRole = errors.New("unknown role")
+
+// Permissions name what users may do, as "<resource>:<action>".
+const (
+	PermissionUsersRead   = "users:read"
+	PermissionUsersCreate = "users:create"
+	PermissionUsersUpdate = "users:update"
+	PermissionUsersDelete = "users:delete"
+	// PermissionUsersRoles allows changing which roles users have.
+	PermissionUsersRoles = "users:roles"
+	// PermissionUsersDisable allows disabling users, so they can't log in, and enabling them again.
+	PermissionUsersDisable = "users:disable"
+)
+
+// RoleAdmin is the role with every permission.
+const RoleAdmin = "admin"
+
+// Role is a named set of permissions, which users are given by being assigned the role.
+type Role struct {
+	Name        string   `db:"name" json:"name" xml:"name"`
+	Description string   `db:"description" json:"description" xml:"description"`
+	Permissions []string `db:"-" json:"permissions" xml:"permission"`
+}
+
+// DefaultRoles are the built-in roles, which the app creates at startup with EnsureRoles.
+var DefaultRoles = []Role{
+	{
+		Name:        RoleAdmin,
+		Description: "Can do anything, including change users' roles",
+		Permissions: []string{
+			PermissionUsersRead, PermissionUsersCreate, PermissionUsersUpdate, PermissionUsersDelete, PermissionUsersRoles,
+			PermissionUsersDisable,
+		},
+	},
+	{
+		Name:        "editor",
+		Description: "Can view, create and edit users",
+		Permissions: []string{PermissionUsersRead, PermissionUsersCreate, PermissionUsersUpdate},
+	},
+	{
+		Name:        "viewer",
+		Description: "Can view users",
+		Permissions: []string{PermissionUsersRead},
+	},
+}
+
+// RoleStore is the set of operations on roles and their assignment to users. It's part of UserStore.
+type RoleStore interface {
+	// EnsureRoles creates the given roles if they don't exist and adds any permissions they're missing, leaving any
+	// other roles and permissions alone.
+	EnsureRoles(ctx context.Context, roles []Role) error
+	// GetRoles returns every role, by name.
+	GetRoles(ctx context.Context) ([]*Role, error)
+	// GetUserRoles returns the names of the user's roles, in order.
+	GetUserRoles(ctx context.Context, userID int) ([]string, error)
+	// SetUserRoles replaces the user's roles, returning ErrUnknownRole if any don't exist.
+	SetUserRoles(ctx context.Context, userID int, roles []string) error
+	// GetRolePermissions returns every permission any of the given roles has, in order.
+	GetRolePermissions(ctx context.Context, roles []string) ([]string, error)
+	// GrantFirstRole assigns the role to the user only if nobody has it yet, e.g. to bootstrap the first admin, and
+	// reports whether it did.
+	GrantFirstRole(ctx context.Context, userID int, role string) (bool, error)
+	// CountActiveRoleUsers returns how many users who aren't disabled have the role.
+	CountActiveRoleUsers(ctx context.Context, role string) (int, error)
+}
+
+// EnsureRoles runs its queries in a transaction, so the roles are created entirely or not at all.
+func (db *DB) EnsureRoles(ctx context.Context, roles []Role) error {
+	return db.InTx(ctx, func(tx *Tx) error { return tx.EnsureRoles(ctx, roles) })
+}
+
+// SetUserRoles runs its queries in a transaction, so the user's roles are replaced all at once.
+func (db *DB) SetUserRoles(ctx context.Context, userID int, roles []string) error {
+	return db.InTx(ctx, func(tx *Tx) error { return tx.SetUserRoles(ctx, userID, roles) })
+}
+
+// GrantFirstRole runs its queries in a transaction, so two users can't both be granted the role.
+func (db *DB) GrantFirstRole(ctx context.Context, userID int, role string) (bool, error) {
+	var granted bool
+	err := db.InTx(ctx, func(tx *Tx) error {
+		var err error
+		granted, err = tx.GrantFirstRole(ctx, userID, role)
+		return err
+	})
+	return granted, err
+}
+
+func (q *queries) EnsureRoles(ctx context.Context, roles []Role) (err error) {
+	ctx, end := q.startQuery(ctx, "EnsureRoles")
+	defer end(&err)
+
+	for _, role := range roles {
+		_, err := q.ext.ExecContext(ctx, "INSERT INTO roles (name, description) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			role.Name, role.Description)
+		if err != nil {
+			return fmt.Errorf("could not create role %s: %w", role.Name, err)
+		}
+		_, err = q.ext.ExecContext(ctx, `INSERT INTO role_permissions (role, permission)
+			SELECT $1, permission FROM unnest($2::text[]) AS t(permission)
+			ON CONFLICT DO NOTHING`, role.Name, role.Permissions)
+		if err != nil {
+			return fmt.Errorf("could not add permissions to role %s: %w", role.Name, err)
+		}
+	}
+	return nil
+}
+
+func (q *queries) GetRoles(ctx context.Context) (_ []*Role, err error) {
+	ctx, end := q.startQuery(ctx, "GetRoles")
+	defer end(&err)
+
+	roles := []*Role{}
+	if err := sqlx.SelectContext(ctx, q.ext, &roles, "SELECT name, description FROM roles ORDER BY name"); err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		err := sqlx.SelectContext(ctx, q.ext, &role.Permissions,
+			"SELECT permission FROM role_permissions WHERE role=$1 ORDER BY permission", role.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
+}
+
+func (q *queries) GetUserRoles(ctx context.Context, userID int) (_ []string, err error) {
+	ctx, end := q.startQuery(ctx, "GetUserRoles")
+	defer end(&err)
+
+	roles := []string{}
+	err = sqlx.SelectContext(ctx, q.ext, &roles, "SELECT role FROM user_roles WHERE user_id=$1 ORDER BY role", userID)
+	return roles, err
+}
+
+func (q *queries) SetUserRoles(ctx context.Context, userID int, roles []string) (err error) {
+	ctx, end := q.startQuery(ctx, "SetUserRoles")
+	defer end(&err)
+
+	var known []string
+	if err := sqlx.SelectContext(ctx, q.ext, &known, "SELECT name FROM roles WHERE name = ANY($1)", roles); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if !slices.Contains(known, role) {
+			return fmt.Errorf("%w %q", ErrUnknownRole, role)
+		}
+	}
+
+	if _, err := q.ext.ExecContext(ctx, "DELETE FROM user_roles WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	_, err = q.ext.ExecContext(ctx, `INSERT INTO user_roles (user_id, role)
+		SELECT $1, role FROM unnest($2::text[]) AS t(role)
+		ON CONFLICT DO NOTHING`, userID, roles)
+	return err
+}
+
+func (q *queries) GetRolePermissions(ctx context.Context, roles []string) (_ []string, err error) {
+	ctx, end := q.startQuery(ctx, "GetRolePermissions")
+	defer end(&err)
+
+	permissions := []string{}
+	err = sqlx.SelectContext(ctx, q.ext, &permissions,
+		"SELECT DISTINCT permission FROM role_permissions WHERE role = ANY($1) ORDER BY permission", roles)
+	return permissions, err
+}
+
+func (q *queries) GrantFirstRole(ctx context.Context, userID int, role string) (_ bool, err error) {
+	ctx, end := q.startQuery(ctx, "GrantFirstRole")
+	defer end(&err)
+
+	var exists bool
+	if err := sqlx.GetContext(ctx, q.ext, &exists, "SELECT EXISTS (SELECT 1 FROM roles WHERE name=$1)", role); err != nil {
+		return false, err
+	} else if !exists {
+		return false, fmt.Errorf("%w %q", ErrUnknownRole, role)
+	}
+
+	result, err := q.ext.ExecContext(ctx, `INSERT INTO user_roles (user_id, role)
+		SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM user_roles WHERE role=$2)`, userID, role)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (q *queries) CountActiveRoleUsers(ctx context.Context, role string) (_ int, err error) {
+	ctx, end := q.startQuery(ctx, "CountActiveRoleUsers")
+	defer end(&err)
+
+	var count int
+	err = sqlx.GetContext(ctx, q.ext, &count, `SELECT count(*) FROM user_roles
+		JOIN users ON users.id = user_roles.user_id
+		WHERE user_roles.role=$1 AND NOT users.disabled`, role)
+	return count, err
+}
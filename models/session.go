@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// defaultSessionMaxAge is how long a session lives, in seconds, unless its options say otherwise. It's also used for
+// sessions whose cookie lasts until the browser closes (MaxAge 0), since we can't tell when that happens.
+const defaultSessionMaxAge = 30 * 24 * 60 * 60
+
+// SessionStore is a sessions.Store that keeps session data in the sessions table, leaving only a signed session ID in
+// the cookie. Unlike a cookie store, its sessions can be revoked: once a session's row is deleted its cookie is
+// worthless.
+type SessionStore struct {
+	// Options are the defaults for new sessions, which may change their own copy.
+	Options *sessions.Options
+	// OwnerKey is the session value identifying who the session belongs to (e.g. the user's ID), which is recorded, as
+	// text, so that all of someone's sessions can be revoked together. If empty, sessions aren't recorded with an owner.
+	OwnerKey string
+
+	db     *DB
+	codecs []securecookie.Codec
+}
+
+var _ sessions.Store = (*SessionStore)(nil)
+
+// NewSessionStore returns a store keeping sessions in the database, signing session IDs in cookies with the given
+// keys as for sessions.NewCookieStore.
+func NewSessionStore(db *DB, keyPairs ...[]byte) *SessionStore {
+	return &SessionStore{
+		Options: &sessions.Options{Path: "/", MaxAge: defaultSessionMaxAge, HttpOnly: true, SameSite: http.SameSiteLaxMode},
+		db:      db,
+		codecs:  securecookie.CodecsFromPairs(keyPairs...),
+	}
+}
+
+// Get returns the named session for the request, loading it at most once per request.
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the named session for the request, or returns a new one if the request has no valid session cookie, or
+// the session has expired or been revoked.
+func (s *SessionStore) New(r *http.Request, name string) (_ *sessions.Session, err error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.codecs...); err != nil {
+		// A cookie we didn't sign, or signed with a key since retired; start afresh.
+		return session, nil
+	}
+
+	ctx, end := s.db.startQuery(r.Context(), "GetSession")
+	defer end(&err)
+	var data []byte
+	err = s.db.QueryRowContext(ctx, "SELECT data FROM sessions WHERE id=$1 AND expires_at > now()", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, nil
+	} else if err != nil {
+		return session, fmt.Errorf("could not load session: %w", err)
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, fmt.Errorf("could not decode session: %w", err)
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session and sets its cookie, or deletes both if the session's MaxAge is negative.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) (err error) {
+	ctx, end := s.db.startQuery(r.Context(), "SaveSession")
+	defer end(&err)
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id=$1", session.ID); err != nil {
+				return fmt.Errorf("could not delete session: %w", err)
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = rand.Text()
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return fmt.Errorf("could not encode session: %w", err)
+	}
+	var owner sql.NullString
+	if v := session.Values[s.OwnerKey]; s.OwnerKey != "" && v != nil && v != "" {
+		owner = sql.NullString{String: fmt.Sprint(v), Valid: true}
+	}
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultSessionMaxAge
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO sessions (id, data, owner, expires_at)
+		VALUES ($1, $2, $3, now() + make_interval(secs => $4))
+		ON CONFLICT (id) DO UPDATE SET data=EXCLUDED.data, owner=EXCLUDED.owner, expires_at=EXCLUDED.expires_at`,
+		session.ID, data, owner, float64(maxAge))
+	if err != nil {
+		return fmt.Errorf("could not save session: %w", err)
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return fmt.Errorf("could not encode session cookie: %w", err)
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew gives the session a new ID when it's next saved, deleting it under its old one, e.g. on login so that a session
+// ID planted in a victim's browser before they logged in isn't logged in too.
+func (s *SessionStore) Renew(ctx context.Context, session *sessions.Session) (err error) {
+	if session.ID == "" {
+		return nil
+	}
+	ctx, end := s.db.startQuery(ctx, "RenewSession")
+	defer end(&err)
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id=$1", session.ID); err != nil {
+		return fmt.Errorf("could not delete session: %w", err)
+	}
+	session.ID = ""
+	return nil
+}
+
+// RevokeSessions deletes every session belonging to the given owner (see OwnerKey), logging them out everywhere, and
+// returns how many there were.
+func (s *SessionStore) RevokeSessions(ctx context.Context, owner string) (_ int64, err error) {
+	ctx, end := s.db.startQuery(ctx, "RevokeSessions")
+	defer end(&err)
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE owner=$1", owner)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpired deletes sessions that have expired, returning how many there were. Expired sessions are never loaded,
+// so this just keeps the table from growing forever.
+func (s *SessionStore) DeleteExpired(ctx context.Context) (_ int64, err error) {
+	ctx, end := s.db.startQuery(ctx, "DeleteExpiredSessions")
+	defer end(&err)
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= now()")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// saveSession saves the session and returns a request carrying the cookie it set.
+func saveSession(t *testing.T, store *SessionStore, r *http.Request, name string, values map[any]any) *http.Request {
+	s, err := store.Get(r, name)
+	require.NoError(t, err)
+	for k, v := range values {
+		s.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	require.NoError(t, store.Save(r, w, s))
+
+	next := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		next.AddCookie(c)
+	}
+	return next
+}
+
+// TestSessionStore validates that sessions are saved to and loaded from the database, and can be revoked or expire.
+func TestSessionStore(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+	store := NewSessionStore(f.db, []byte("0123456789abcdef0123456789abcdef"))
+	store.OwnerKey = "UserID"
+
+	r := saveSession(t, store, httptest.NewRequest(http.MethodGet, "/", nil), "s", map[any]any{"UserID": 1})
+	s, err := store.Get(r, "s")
+	require.NoError(t, err)
+	assert.False(t, s.IsNew)
+	assert.Equal(t, 1, s.Values["UserID"])
+
+	// A cookie we didn't sign is ignored.
+	forged := httptest.NewRequest(http.MethodGet, "/", nil)
+	forged.AddCookie(&http.Cookie{Name: "s", Value: s.ID})
+	s, err = store.Get(forged, "s")
+	require.NoError(t, err)
+	assert.True(t, s.IsNew)
+
+	// Revoking someone's sessions logs them out.
+	other := saveSession(t, store, httptest.NewRequest(http.MethodGet, "/", nil), "s", map[any]any{"UserID": 2})
+	n, err := store.RevokeSessions(t.Context(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	s, err = store.New(r, "s")
+	require.NoError(t, err)
+	assert.True(t, s.IsNew)
+	assert.Empty(t, s.Values)
+	s, err = store.New(other, "s")
+	require.NoError(t, err)
+	assert.False(t, s.IsNew, "other users' sessions are untouched")
+
+	// Expired sessions aren't loaded, and are cleaned up.
+	_, err = f.db.ExecContext(t.Context(), "UPDATE sessions SET expires_at = now() - interval '1 minute'")
+	require.NoError(t, err)
+	s, err = store.New(other, "s")
+	require.NoError(t, err)
+	assert.True(t, s.IsNew)
+	n, err = store.DeleteExpired(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	// A negative MaxAge deletes the session.
+	r = saveSession(t, store, httptest.NewRequest(http.MethodGet, "/", nil), "s", map[any]any{"a": "b"})
+	s, err = store.New(r, "s")
+	require.NoError(t, err)
+	s.Options.MaxAge = -1
+	require.NoError(t, store.Save(r, httptest.NewRecorder(), s))
+	s, err = store.New(r, "s")
+	require.NoError(t, err)
+	assert.True(t, s.IsNew)
+}
+
+// TestSessionStoreRenew validates that a renewed session is saved under a new ID, and its old ID no longer works.
+func TestSessionStoreRenew(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+	store := NewSessionStore(f.db, []byte("0123456789abcdef0123456789abcdef"))
+
+	planted := saveSession(t, store, httptest.NewRequest(http.MethodGet, "/", nil), "s", map[any]any{"a": "b"})
+	s, err := store.New(planted, "s")
+	require.NoError(t, err)
+	oldID := s.ID
+	require.NoError(t, store.Renew(t.Context(), s))
+	s.Values["UserID"] = 1
+	w := httptest.NewRecorder()
+	require.NoError(t, store.Save(planted, w, s))
+	assert.NotEqual(t, oldID, s.ID)
+
+	s, err = store.New(planted, "s")
+	require.NoError(t, err)
+	assert.True(t, s.IsNew, "the old ID isn't logged in")
+	assert.Empty(t, s.Values)
+}
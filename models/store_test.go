@@ -0,0 +1,406 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryUserStore runs the UserStore contract against the in-memory implementation.
+func TestMemoryUserStore(t *testing.T) {
+	t.Parallel()
+	testUserStore(t, func(t *testing.T) UserStore {
+		return NewMemoryUserStore()
+	})
+}
+
+// TestDBUserStore runs the UserStore contract against the database.
+func TestDBUserStore(t *testing.T) {
+	t.Parallel()
+	testUserStore(t, func(t *testing.T) UserStore {
+		f := NewFixture(t)
+		t.Cleanup(f.Cleanup)
+		return f.db
+	})
+}
+
+// testUserStore checks the behavior every UserStore must share, so tests using the in-memory store can trust it acts
+// like the database. newStore must return an empty store.
+func testUserStore(t *testing.T, newStore func(t *testing.T) UserStore) {
+	t.Run("CRUD", func(t *testing.T) {
+		s := newStore(t)
+
+		u, err := s.CreateUser(t.Context(), &User{Name: "Tim"})
+		require.NoError(t, err)
+		assert.Equal(t, &User{ID: 1, Name: "Tim"}, withoutTimes(u))
+		assert.False(t, u.CreatedAt.IsZero())
+		assert.Equal(t, u.CreatedAt, u.UpdatedAt)
+		assert.Nil(t, u.LastLoginAt)
+		u2, err := s.CreateUser(t.Context(), &User{ID: 7, Name: "Tom"})
+		require.NoError(t, err)
+		assert.Equal(t, 2, u2.ID, "IDs are assigned by the store")
+
+		// Changing a returned user mustn't change the stored one.
+		u.Name = "Timothy"
+		got, err := s.GetUserByID(t.Context(), 1)
+		require.NoError(t, err)
+		assert.Equal(t, "Tim", got.Name)
+
+		u.Disabled = true
+		require.NoError(t, s.UpdateUser(t.Context(), u))
+		got, err = s.GetUserByID(t.Context(), 1)
+		require.NoError(t, err)
+		assert.Equal(t, withoutTimes(u), withoutTimes(got))
+		assert.False(t, got.UpdatedAt.Before(u.UpdatedAt))
+
+		require.NoError(t, s.DeleteUser(t.Context(), 1))
+		_, err = s.GetUserByID(t.Context(), 1)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		assert.ErrorIs(t, s.UpdateUser(t.Context(), u), sql.ErrNoRows)
+		assert.NoError(t, s.DeleteUser(t.Context(), 1), "deleting a missing user isn't an error")
+
+		// IDs aren't reused after a delete.
+		u3, err := s.CreateUser(t.Context(), &User{Name: "Tam"})
+		require.NoError(t, err)
+		assert.Equal(t, 3, u3.ID)
+	})
+
+	t.Run("CreateUsersAndEachUser", func(t *testing.T) {
+		s := newStore(t)
+
+		created, err := s.CreateUsers(t.Context(), []*User{{Name: "Carol"}, {Name: "Alice"}, {Name: "Bob"}})
+		require.NoError(t, err)
+		assert.Equal(t, []*User{{ID: 1, Name: "Carol"}, {ID: 2, Name: "Alice"}, {ID: 3, Name: "Bob"}}, allWithoutTimes(created))
+
+		var users []*User
+		require.NoError(t, s.EachUser(t.Context(), func(u *User) error {
+			users = append(users, u)
+			return nil
+		}))
+		assert.Equal(t, allWithoutTimes(created), allWithoutTimes(users))
+
+		stop := errors.New("stop")
+		assert.ErrorIs(t, s.EachUser(t.Context(), func(u *User) error { return stop }), stop)
+	})
+
+	t.Run("GetUsers", func(t *testing.T) {
+		s := newStore(t)
+
+		_, err := s.CreateUsers(t.Context(), []*User{
+			{Name: "Eve"}, {Name: "Alice"}, {Name: "Dave"}, {Name: "Carol"}, {Name: "Bob"}, {Name: "Alice"},
+		})
+		require.NoError(t, err)
+
+		for _, tc := range []struct {
+			name  string
+			query UserQuery
+			want  []int
+		}{
+			{"default", UserQuery{}, []int{1, 2, 3, 4, 5, 6}},
+			{"id desc", UserQuery{PageOptions: PageOptions{Desc: true}}, []int{6, 5, 4, 3, 2, 1}},
+			{"name", UserQuery{PageOptions: PageOptions{Sort: "name"}}, []int{2, 6, 5, 4, 3, 1}},
+			{"name desc", UserQuery{PageOptions: PageOptions{Sort: "name", Desc: true}}, []int{1, 3, 4, 5, 6, 2}},
+			{"filter", UserQuery{Name: "AL"}, []int{2, 6}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				q := tc.query
+				q.PageSize = 2
+				var ids []int
+				var page *Page[*User]
+				for {
+					var err error
+					page, err = s.GetUsers(t.Context(), q)
+					require.NoError(t, err)
+					for _, u := range page.Items {
+						ids = append(ids, u.ID)
+					}
+					if page.NextCursor == "" {
+						break
+					}
+					q.Cursor = page.NextCursor
+				}
+				assert.Equal(t, tc.want, ids)
+
+				// Page back from the last page to the first.
+				last := len(page.Items)
+				ids = []int{}
+				for page.PrevCursor != "" {
+					q.Cursor = page.PrevCursor
+					var err error
+					page, err = s.GetUsers(t.Context(), q)
+					require.NoError(t, err)
+					var pageIDs []int
+					for _, u := range page.Items {
+						pageIDs = append(pageIDs, u.ID)
+					}
+					ids = append(pageIDs, ids...)
+				}
+				assert.Equal(t, tc.want[:len(tc.want)-last], ids)
+			})
+		}
+
+		_, err = s.GetUsers(t.Context(), UserQuery{PageOptions: PageOptions{Sort: "password"}})
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+		_, err = s.GetUsers(t.Context(), UserQuery{PageOptions: PageOptions{Cursor: "garbage"}})
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+	})
+
+	t.Run("LoginUser", func(t *testing.T) {
+		s := newStore(t)
+
+		tim, err := s.CreateUser(t.Context(), &User{Name: "Tim"})
+		require.NoError(t, err)
+
+		// The first login creates a user, and later ones find them by their identity.
+		login := Login{Provider: "google", ProviderUserID: "123", Email: "tom@example.com", Name: "Tom", AvatarURL: "https://example.com/tom.png"}
+		tom, err := s.LoginUser(t.Context(), login)
+		require.NoError(t, err)
+		assert.Equal(t, &User{ID: 2, Name: "Tom", Email: "tom@example.com", AvatarURL: "https://example.com/tom.png"}, withoutTimes(tom))
+		require.NotNil(t, tom.LastLoginAt)
+		login.Email = "thomas@example.com"
+		again, err := s.LoginUser(t.Context(), login)
+		require.NoError(t, err)
+		assert.Equal(t, tom.ID, again.ID)
+		assert.Equal(t, "tom@example.com", again.Email, "the email isn't replaced")
+
+		// Logging in with another provider links it to the user with the same email.
+		github, err := s.LoginUser(t.Context(), Login{Provider: "github", ProviderUserID: "abc", Email: "TOM@example.com"})
+		require.NoError(t, err)
+		assert.Equal(t, tom.ID, github.ID)
+		identities, err := s.GetUserIdentities(t.Context(), tom.ID)
+		require.NoError(t, err)
+		require.Len(t, identities, 2)
+		assert.Equal(t, "google", identities[0].Provider)
+		assert.Equal(t, "github", identities[1].Provider)
+		identities, err = s.GetUserIdentities(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Empty(t, identities)
+
+		// Without a name, new users are named by their email.
+		u, err := s.LoginUser(t.Context(), Login{Provider: "github", ProviderUserID: "def", Email: "sam@example.com"})
+		require.NoError(t, err)
+		assert.Equal(t, "sam@example.com", u.Name)
+
+		// Disabled users can't log in.
+		tom.Disabled = true
+		require.NoError(t, s.UpdateUser(t.Context(), tom))
+		_, err = s.LoginUser(t.Context(), login)
+		assert.ErrorIs(t, err, ErrUserDisabled)
+
+		// Deleting a user deletes their identities, so logging in again makes a new user.
+		require.NoError(t, s.DeleteUser(t.Context(), tom.ID))
+		identities, err = s.GetUserIdentities(t.Context(), tom.ID)
+		require.NoError(t, err)
+		assert.Empty(t, identities)
+		u, err = s.LoginUser(t.Context(), login)
+		require.NoError(t, err)
+		assert.NotEqual(t, tom.ID, u.ID)
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.EnsureRoles(t.Context(), DefaultRoles))
+		// Ensuring them again adds missing permissions but leaves the rest alone.
+		require.NoError(t, s.EnsureRoles(t.Context(), []Role{{Name: "viewer", Permissions: []string{"users:export"}}}))
+		roles, err := s.GetRoles(t.Context())
+		require.NoError(t, err)
+		require.Len(t, roles, 3)
+		assert.Equal(t, &Role{Name: "viewer", Description: "Can view users", Permissions: []string{"users:export", "users:read"}}, roles[2])
+
+		tim, err := s.CreateUser(t.Context(), &User{Name: "Tim"})
+		require.NoError(t, err)
+		tom, err := s.CreateUser(t.Context(), &User{Name: "Tom"})
+		require.NoError(t, err)
+		userRoles, err := s.GetUserRoles(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Empty(t, userRoles)
+
+		require.NoError(t, s.SetUserRoles(t.Context(), tim.ID, []string{"viewer", "editor"}))
+		userRoles, err = s.GetUserRoles(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"editor", "viewer"}, userRoles)
+		permissions, err := s.GetRolePermissions(t.Context(), userRoles)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"users:create", "users:export", "users:read", "users:update"}, permissions)
+		assert.ErrorIs(t, s.SetUserRoles(t.Context(), tim.ID, []string{"viewer", "superuser"}), ErrUnknownRole)
+		userRoles, err = s.GetUserRoles(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"editor", "viewer"}, userRoles, "unchanged by the failed update")
+
+		// Only the first user granted a role gets it.
+		granted, err := s.GrantFirstRole(t.Context(), tim.ID, RoleAdmin)
+		require.NoError(t, err)
+		assert.True(t, granted)
+		granted, err = s.GrantFirstRole(t.Context(), tom.ID, RoleAdmin)
+		require.NoError(t, err)
+		assert.False(t, granted)
+		_, err = s.GrantFirstRole(t.Context(), tom.ID, "superuser")
+		assert.ErrorIs(t, err, ErrUnknownRole)
+
+		// Disabled users don't count.
+		count, err := s.CountActiveRoleUsers(t.Context(), RoleAdmin)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		tim.Disabled = true
+		require.NoError(t, s.UpdateUser(t.Context(), tim))
+		count, err = s.CountActiveRoleUsers(t.Context(), RoleAdmin)
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+
+		// Deleting the user deletes their roles.
+		require.NoError(t, s.DeleteUser(t.Context(), tim.ID))
+		userRoles, err = s.GetUserRoles(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Empty(t, userRoles)
+		granted, err = s.GrantFirstRole(t.Context(), tom.ID, RoleAdmin)
+		require.NoError(t, err)
+		assert.True(t, granted)
+	})
+
+	t.Run("WithTx", func(t *testing.T) {
+		s := newStore(t)
+		require.NoError(t, s.EnsureRoles(t.Context(), DefaultRoles))
+
+		// A unit of work that fails leaves nothing behind.
+		failed := errors.New("failed")
+		err := s.WithTx(t.Context(), func(tx UserStore) error {
+			u, err := tx.CreateUser(t.Context(), &User{Name: "Tim"})
+			require.NoError(t, err)
+			require.NoError(t, tx.SetUserRoles(t.Context(), u.ID, []string{"editor"}))
+			return failed
+		})
+		assert.ErrorIs(t, err, failed)
+		page, err := s.GetUsers(t.Context(), UserQuery{})
+		require.NoError(t, err)
+		assert.Empty(t, page.Items)
+
+		// One that succeeds keeps all its changes.
+		var tim *User
+		require.NoError(t, s.WithTx(t.Context(), func(tx UserStore) error {
+			var err error
+			if tim, err = tx.CreateUser(t.Context(), &User{Name: "Tim"}); err != nil {
+				return err
+			}
+			return tx.SetUserRoles(t.Context(), tim.ID, []string{"editor"})
+		}))
+		got, err := s.GetUserByID(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Tim", got.Name)
+		roles, err := s.GetUserRoles(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"editor"}, roles)
+	})
+
+	t.Run("APITokens", func(t *testing.T) {
+		s := newStore(t)
+
+		tim, err := s.CreateUser(t.Context(), &User{Name: "Tim"})
+		require.NoError(t, err)
+		tom, err := s.CreateUser(t.Context(), &User{Name: "Tom"})
+		require.NoError(t, err)
+
+		secret, token := NewAPIToken(tim.ID, "deploy script", []string{PermissionUsersRead}, nil)
+		assert.True(t, strings.HasPrefix(secret, token.Hint))
+		created, err := s.CreateAPIToken(t.Context(), token)
+		require.NoError(t, err)
+		assert.Equal(t, "deploy script", created.Name)
+		assert.Equal(t, Scopes{PermissionUsersRead}, created.Scopes)
+		assert.Nil(t, created.LastUsedAt)
+
+		past := time.Now().Add(-time.Hour)
+		expiredSecret, expired := NewAPIToken(tim.ID, "old", []string{PermissionUsersRead, PermissionUsersUpdate}, &past)
+		expired, err = s.CreateAPIToken(t.Context(), expired)
+		require.NoError(t, err)
+		assert.True(t, expired.Expired())
+
+		tokens, err := s.GetUserAPITokens(t.Context(), tim.ID)
+		require.NoError(t, err)
+		require.Len(t, tokens, 2)
+		assert.Equal(t, expired.ID, tokens[0].ID, "newest first")
+		tokens, err = s.GetUserAPITokens(t.Context(), tom.ID)
+		require.NoError(t, err)
+		assert.Empty(t, tokens)
+
+		used, err := s.UseAPIToken(t.Context(), HashAPIToken(secret))
+		require.NoError(t, err)
+		assert.Equal(t, created.ID, used.ID)
+		assert.Equal(t, tim.ID, used.UserID)
+		assert.NotNil(t, used.LastUsedAt)
+		used, err = s.UseAPIToken(t.Context(), HashAPIToken(expiredSecret))
+		assert.ErrorIs(t, err, sql.ErrNoRows, "expired")
+		assert.Nil(t, used)
+		_, err = s.UseAPIToken(t.Context(), HashAPIToken(APITokenPrefix+"wrong"))
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// Users can only revoke their own tokens.
+		assert.ErrorIs(t, s.DeleteAPIToken(t.Context(), tom.ID, created.ID), sql.ErrNoRows)
+		require.NoError(t, s.DeleteAPIToken(t.Context(), tim.ID, created.ID))
+		_, err = s.UseAPIToken(t.Context(), HashAPIToken(secret))
+		assert.ErrorIs(t, err, sql.ErrNoRows, "revoked")
+
+		// Deleting the user deletes their tokens.
+		require.NoError(t, s.DeleteUser(t.Context(), tim.ID))
+		tokens, err = s.GetUserAPITokens(t.Context(), tim.ID)
+		require.NoError(t, err)
+		assert.Empty(t, tokens)
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		s := newStore(t)
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		_, err := s.GetUsers(ctx, UserQuery{})
+		assert.ErrorIs(t, err, context.Canceled)
+		_, err = s.CreateUser(ctx, &User{Name: "Tim"})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+// TestMemoryUserStoreConcurrent validates the in-memory store is safe to share between goroutines (run with -race).
+func TestMemoryUserStoreConcurrent(t *testing.T) {
+	s := NewMemoryUserStore()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			u, err := s.CreateUser(t.Context(), &User{Name: "Tim"})
+			assert.NoError(t, err)
+			u.Name = "Tom"
+			assert.NoError(t, s.UpdateUser(t.Context(), u))
+			_, err = s.GetUsers(t.Context(), UserQuery{})
+			assert.NoError(t, err)
+		})
+	}
+	wg.Wait()
+
+	page, err := s.GetUsers(t.Context(), UserQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 10)
+	for i, u := range page.Items {
+		assert.Equal(t, &User{ID: i + 1, Name: "Tom"}, withoutTimes(u))
+	}
+}
+
+// withoutTimes returns a copy of the user without the timestamps the store sets, for comparing with expected users.
+func withoutTimes(u *User) *User {
+	c := *u
+	c.CreatedAt, c.UpdatedAt, c.LastLoginAt = time.Time{}, time.Time{}, nil
+	return &c
+}
+
+func allWithoutTimes(users []*User) []*User {
+	copies := make([]*User, len(users))
+	for i, u := range users {
+		copies[i] = withoutTimes(u)
+	}
+	return copies
+}
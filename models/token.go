@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// APITokenPrefix starts every API token, so they're easy to recognize, e.g. by secret scanners.
+const APITokenPrefix = "kbx_"
+
+// APIToken is a personal access token, which lets scripts act as the user who created it without a browser session.
+// Only a hash of the token is stored, so it can't be shown again after it's created.
+type APIToken struct {
+	ID     int    `db:"id" json:"id" xml:"id"`
+	UserID int    `db:"user_id" json:"user_id" xml:"user_id"`
+	Name   string `db:"name" json:"name" xml:"name"`
+	// Hint is the start of the token, to help users tell their tokens apart.
+	Hint string `db:"hint" json:"hint" xml:"hint"`
+	Hash []byte `db:"token_hash" json:"-" xml:"-"`
+	// Scopes are the permissions the token grants, of those its user has, e.g. "users:read".
+	Scopes     Scopes     `db:"scopes" json:"scopes" xml:"scope"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at" xml:"created_at"`
+	ExpiresAt  *time.Time `db:"expires_at" json:"expires_at" xml:"expires_at,omitempty"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at" xml:"last_used_at,omitempty"`
+}
+
+// Expired reports whether the token has expired, and so can no longer be used.
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now())
+}
+
+// Scopes is a list of scopes, stored space-separated like OAuth scopes.
+type Scopes []string
+
+// Scan implements sql.Scanner.
+func (s *Scopes) Scan(src any) error {
+	var str string
+	switch v := src.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("cannot scan %T into Scopes", src)
+	}
+	*s = strings.Fields(str)
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, " "), nil
+}
+
+// NewAPIToken generates a new random token, returning it along with the token to store, which has its hint and hash.
+func NewAPIToken(userID int, name string, scopes []string, expiresAt *time.Time) (string, *APIToken) {
+	secret := APITokenPrefix + rand.Text()
+	return secret, &APIToken{
+		UserID:    userID,
+		Name:      name,
+		Hint:      secret[:len(APITokenPrefix)+4],
+		Hash:      HashAPIToken(secret),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+}
+
+// HashAPIToken returns the hash a token is stored and looked up by. Tokens are random enough that a fast hash is safe.
+func HashAPIToken(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// APITokenStore is the set of operations on API tokens. It's part of UserStore.
+type APITokenStore interface {
+	CreateAPIToken(ctx context.Context, t *APIToken) (*APIToken, error)
+	// GetUserAPITokens returns the user's tokens, newest first, including expired ones.
+	GetUserAPITokens(ctx context.Context, userID int) ([]*APIToken, error)
+	// UseAPIToken returns the unexpired token with the given hash, noting it was last used now, or sql.ErrNoRows if
+	// there isn't one.
+	UseAPIToken(ctx context.Context, hash []byte) (*APIToken, error)
+	// DeleteAPIToken revokes one of the user's tokens, returning sql.ErrNoRows if they have no such token.
+	DeleteAPIToken(ctx context.Context, userID, id int) error
+}
+
+func (q *queries) CreateAPIToken(ctx context.Context, t *APIToken) (_ *APIToken, err error) {
+	ctx, end := q.startQuery(ctx, "CreateAPIToken")
+	defer end(&err)
+
+	var token APIToken
+	err = sqlx.GetContext(ctx, q.ext, &token, `INSERT INTO api_tokens (user_id, name, hint, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING *`, t.UserID, t.Name, t.Hint, t.Hash, t.Scopes, t.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (q *queries) GetUserAPITokens(ctx context.Context, userID int) (_ []*APIToken, err error) {
+	ctx, end := q.startQuery(ctx, "GetUserAPITokens")
+	defer end(&err)
+
+	tokens := []*APIToken{}
+	err = sqlx.SelectContext(ctx, q.ext, &tokens,
+		"SELECT * FROM api_tokens WHERE user_id=$1 ORDER BY created_at DESC, id DESC", userID)
+	return tokens, err
+}
+
+func (q *queries) UseAPIToken(ctx context.Context, hash []byte) (_ *APIToken, err error) {
+	ctx, end := q.startQuery(ctx, "UseAPIToken")
+	defer end(&err)
+
+	var token APIToken
+	err = sqlx.GetContext(ctx, q.ext, &token, `UPDATE api_tokens SET last_used_at = now()
+		WHERE token_hash=$1 AND (expires_at IS NULL OR expires_at > now()) RETURNING *`, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (q *queries) DeleteAPIToken(ctx context.Context, userID, id int) (err error) {
+	ctx, end := q.startQuery(ctx, "DeleteAPIToken")
+	defer end(&err)
+
+	result, err := q.ext.ExecContext(ctx, "DELETE FROM api_tokens WHERE id=$1 AND user_id=$2", id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
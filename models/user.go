@@ -1,32 +1,206 @@
 package models
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	DefaultPageSize = 25
+	MaxPageSize     = 100
+)
+
+// ErrInvalidQuery is returned (wrapped) when a query's options can't be satisfied, e.g. an unknown sort field.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// MaxNameLength is the longest name, in characters, a user may have.
+const MaxNameLength = 100
 
 type User struct {
-	ID   int    `db:"id" json:"id" formam:"id"`
-	Name string `db:"name" json:"name" formam:"name"`
+	// XMLName names a user's element <user>, both alone and in listings.
+	XMLName xml.Name `db:"-" json:"-" xml:"user" formam:"-"`
+
+	ID   int    `db:"id" json:"id" xml:"id" formam:"id"`
+	Name string `db:"name" json:"name" xml:"name" formam:"name"`
+	// Email and AvatarURL are filled in from the user's first login with an identity provider.
+	Email     string `db:"email" json:"email" xml:"email" formam:"-"`
+	AvatarURL string `db:"avatar_url" json:"avatar_url" xml:"avatar_url" formam:"-"`
+	// Disabled users can't log in, and are logged out if they already are.
+	Disabled    bool       `db:"disabled" json:"disabled" xml:"disabled" formam:"disabled"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at" xml:"created_at" formam:"-"`
+	UpdatedAt   time.Time  `db:"updated_at" json:"updated_at" xml:"updated_at" formam:"-"`
+	LastLoginAt *time.Time `db:"last_login_at" json:"last_login_at" xml:"last_login_at,omitempty" formam:"-"`
 }
 
-func (db *DB) GetUsers() ([]*User, error) {
-	var users []*User
-	err := db.Select(&users, "SELECT * FROM users ORDER BY id ASC")
-	return users, err
+// Validate checks the user's fields, implementing Validator.
+func (u *User) Validate() ValidationErrors {
+	errs := ValidationErrors{}
+	if strings.TrimSpace(u.Name) == "" {
+		errs["name"] = "must not be blank"
+	} else if utf8.RuneCountInString(u.Name) > MaxNameLength {
+		errs["name"] = fmt.Sprintf("must be at most %d characters", MaxNameLength)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// UserStore is the set of operations on users the app depends on. It's implemented by DB and Tx, and by
+// MemoryUserStore for tests that don't need a real database.
+type UserStore interface {
+	GetUsers(ctx context.Context, query UserQuery) (*Page[*User], error)
+	CreateUser(ctx context.Context, u *User) (*User, error)
+	CreateUsers(ctx context.Context, us []*User) ([]*User, error)
+	EachUser(ctx context.Context, fn func(*User) error) error
+	// GetUserByID returns sql.ErrNoRows if there's no such user.
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	// UpdateUser returns sql.ErrNoRows if there's no such user.
+	UpdateUser(ctx context.Context, u *User) error
+	DeleteUser(ctx context.Context, id int) error
+	// LoginUser returns the user who logged in, creating them if need be, see Login.
+	LoginUser(ctx context.Context, login Login) (*User, error)
+	GetUserIdentities(ctx context.Context, userID int) ([]*Identity, error)
+	// WithTx runs fn as a unit of work, with a store whose changes are all kept if fn returns nil and none are if it
+	// returns an error, so handlers can make several changes atomically. fn may be run more than once if it conflicts
+	// with a concurrent unit of work, so it shouldn't have side effects outside the store.
+	WithTx(ctx context.Context, fn func(UserStore) error) error
+
+	RoleStore
+	APITokenStore
+}
+
+var (
+	_ UserStore = (*DB)(nil)
+	_ UserStore = (*Tx)(nil)
+)
+
+// userSortColumns maps the fields users can be sorted by to their columns.
+var userSortColumns = map[string]string{
+	"id":   "id",
+	"name": "name",
+}
+
+// UserQuery describes which users GetUsers should return and in what order. Sort may be "id" (the default) or "name".
+type UserQuery struct {
+	PageOptions
+	// Name filters to users whose name contains it, case-insensitively.
+	Name string
+}
+
+// GetUsers returns a page of users using keyset pagination, so that deep pages are as cheap as the first.
+func (q *queries) GetUsers(ctx context.Context, query UserQuery) (_ *Page[*User], err error) {
+	if query.Sort == "" {
+		query.Sort = "id"
+	}
+	col, ok := userSortColumns[query.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort field %q", ErrInvalidQuery, query.Sort)
+	}
+
+	k := Keyset{Select: "SELECT * FROM users", Column: col, Desc: query.Desc, PageSize: query.PageSize}
+	if query.Name != "" {
+		k.Args = append(k.Args, "%"+escapeLike(query.Name)+"%")
+		k.Where = append(k.Where, fmt.Sprintf("name ILIKE $%d", len(k.Args)))
+	}
+
+	ctx, end := q.startQuery(ctx, "GetUsers")
+	defer end(&err)
+	return selectPage(ctx, q.ext, q.cursors, k, query.Cursor, func(u *User) (any, int) {
+		return u.Name, u.ID
+	})
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern so s matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
 
-func (db *DB) CreateUser(u *User) (*User, error) {
+func (q *queries) CreateUser(ctx context.Context, u *User) (_ *User, err error) {
+	ctx, end := q.startQuery(ctx, "CreateUser")
+	defer end(&err)
+
 	var user User
-	err := db.Get(&user, "INSERT INTO users (name) VALUES ($1) RETURNING *", u.Name)
+	err = sqlx.GetContext(ctx, q.ext, &user, "INSERT INTO users (name) VALUES ($1) RETURNING *", u.Name)
 	return &user, err
 }
 
-func (db *DB) GetUserByID(id int) (*User, error) {
+// CreateUsers runs in a transaction, so either all the users are created or none are.
+func (db *DB) CreateUsers(ctx context.Context, us []*User) ([]*User, error) {
+	var users []*User
+	err := db.InTx(ctx, func(tx *Tx) error {
+		var err error
+		users, err = tx.CreateUsers(ctx, us)
+		return err
+	})
+	return users, err
+}
+
+// CreateUsers inserts all the given users in a single statement.
+func (q *queries) CreateUsers(ctx context.Context, us []*User) (_ []*User, err error) {
+	ctx, end := q.startQuery(ctx, "CreateUsers")
+	defer end(&err)
+
+	names := make([]string, len(us))
+	for i, u := range us {
+		names[i] = u.Name
+	}
+
+	var users []*User
+	err = sqlx.SelectContext(ctx, q.ext, &users, `INSERT INTO users (name)
+		SELECT name FROM unnest($1::text[]) WITH ORDINALITY AS t(name, n) ORDER BY n
+		RETURNING *`, names)
+	return users, err
+}
+
+// EachUser calls fn with every user in ID order, reading them from the database as it goes rather than loading them
+// all into memory. It stops at the first error, returning it. Since it's meant for long exports, it isn't bound by the
+// QueryTimeout, only by ctx.
+func (q *queries) EachUser(ctx context.Context, fn func(*User) error) (err error) {
+	ctx, span := q.startSpan(ctx, "EachUser")
+	defer endSpan(span, &err)
+
+	rows, err := q.ext.QueryxContext(ctx, "SELECT * FROM users ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		if err := rows.StructScan(&u); err != nil {
+			return err
+		}
+		if err := fn(&u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (q *queries) GetUserByID(ctx context.Context, id int) (_ *User, err error) {
+	ctx, end := q.startQuery(ctx, "GetUserByID")
+	defer end(&err)
+
 	var user User
-	err := db.Get(&user, "SELECT * FROM users WHERE id=$1", id)
+	err = sqlx.GetContext(ctx, q.ext, &user, "SELECT * FROM users WHERE id=$1", id)
 	return &user, err
 }
 
-func (db *DB) UpdateUser(u *User) error {
-	result, err := db.Exec("UPDATE users SET name=$1 WHERE id=$2", u.Name, u.ID)
+func (q *queries) UpdateUser(ctx context.Context, u *User) (err error) {
+	ctx, end := q.startQuery(ctx, "UpdateUser")
+	defer end(&err)
+
+	result, err := q.ext.ExecContext(ctx, "UPDATE users SET name=$1, disabled=$2, updated_at=now() WHERE id=$3",
+		u.Name, u.Disabled, u.ID)
 	if err != nil {
 		return err
 	}
@@ -40,7 +214,10 @@ func (db *DB) UpdateUser(u *User) error {
 	return err
 }
 
-func (db *DB) DeleteUser(id int) error {
-	_, err := db.Exec("DELETE FROM users WHERE id=$1", id)
+func (q *queries) DeleteUser(ctx context.Context, id int) (err error) {
+	ctx, end := q.startQuery(ctx, "DeleteUser")
+	defer end(&err)
+
+	_, err = q.ext.ExecContext(ctx, "DELETE FROM users WHERE id=$1", id)
 	return err
 }
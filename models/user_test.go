@@ -1,7 +1,10 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -9,21 +12,137 @@ import (
 
 // TestUsersBasic validates that we can create, get, update, and delete users.
 func TestUsersBasic(t *testing.T) {
+	t.Parallel()
 	f := NewFixture(t)
 	defer f.Cleanup()
 
 	u := &User{ID: 1, Name: "Tim"}
-	newU, err := f.db.CreateUser(u)
+	newU, err := f.db.CreateUser(t.Context(), u)
 	require.NoError(t, err)
-	assert.Equal(t, u, newU)
+	assert.Equal(t, u, withoutTimes(newU))
 
 	u.Name = "Tom"
-	require.NoError(t, f.db.UpdateUser(u))
-	newU, err = f.db.GetUserByID(u.ID)
+	require.NoError(t, f.db.UpdateUser(t.Context(), u))
+	newU, err = f.db.GetUserByID(t.Context(), u.ID)
 	require.NoError(t, err)
-	assert.Equal(t, u, newU)
+	assert.Equal(t, u, withoutTimes(newU))
 
-	require.NoError(t, f.db.DeleteUser(u.ID))
-	_, err = f.db.GetUserByID(u.ID)
+	require.NoError(t, f.db.DeleteUser(t.Context(), u.ID))
+	_, err = f.db.GetUserByID(t.Context(), u.ID)
 	require.Error(t, err)
 }
+
+// TestGetUsersPagination validates that paging forwards and backwards visits every user exactly once, in order.
+func TestGetUsersPagination(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	for _, name := range []string{"Eve", "Alice", "Dave", "Carol", "Bob"} {
+		_, err := f.db.CreateUser(t.Context(), &User{Name: name})
+		require.NoError(t, err)
+	}
+
+	q := UserQuery{PageOptions: PageOptions{PageSize: 2, Sort: "name"}}
+	var names []string
+	var page *Page[*User]
+	for {
+		var err error
+		page, err = f.db.GetUsers(t.Context(), q)
+		require.NoError(t, err)
+		for _, u := range page.Items {
+			names = append(names, u.Name)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"Alice", "Bob", "Carol", "Dave", "Eve"}, names)
+
+	// From the last page, step back to the one before it.
+	require.NotEmpty(t, page.PrevCursor)
+	q.Cursor = page.PrevCursor
+	page, err := f.db.GetUsers(t.Context(), q)
+	require.NoError(t, err)
+	require.Len(t, page.Items, 2)
+	assert.Equal(t, "Carol", page.Items[0].Name)
+	assert.Equal(t, "Dave", page.Items[1].Name)
+	assert.NotEmpty(t, page.NextCursor)
+	assert.NotEmpty(t, page.PrevCursor)
+
+	// A cursor can't be reused with a different sort order.
+	q.Desc = true
+	_, err = f.db.GetUsers(t.Context(), q)
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+}
+
+// TestGetUsersFilter validates the name filter matches case-insensitively and treats wildcards literally.
+func TestGetUsersFilter(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	for _, name := range []string{"Tim", "Tom", "Timothy", "100%"} {
+		_, err := f.db.CreateUser(t.Context(), &User{Name: name})
+		require.NoError(t, err)
+	}
+
+	page, err := f.db.GetUsers(t.Context(), UserQuery{Name: "tim", PageOptions: PageOptions{Desc: true}})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 2)
+	assert.Equal(t, "Timothy", page.Items[0].Name)
+	assert.Equal(t, "Tim", page.Items[1].Name)
+
+	page, err = f.db.GetUsers(t.Context(), UserQuery{Name: "0%"})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	assert.Equal(t, "100%", page.Items[0].Name)
+
+	_, err = f.db.GetUsers(t.Context(), UserQuery{PageOptions: PageOptions{Sort: "password"}})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+}
+
+// TestCreateUsersAndEachUser validates batch creation and streaming back every user in order.
+func TestCreateUsersAndEachUser(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	created, err := f.db.CreateUsers(t.Context(), []*User{{Name: "Alice"}, {Name: "Bob"}, {Name: "Charlie"}})
+	require.NoError(t, err)
+	assert.Equal(t, []*User{{ID: 1, Name: "Alice"}, {ID: 2, Name: "Bob"}, {ID: 3, Name: "Charlie"}}, allWithoutTimes(created))
+
+	var names []string
+	require.NoError(t, f.db.EachUser(t.Context(), func(u *User) error {
+		names = append(names, u.Name)
+		return nil
+	}))
+	assert.Equal(t, []string{"Alice", "Bob", "Charlie"}, names)
+
+	stop := errors.New("stop")
+	assert.ErrorIs(t, f.db.EachUser(t.Context(), func(u *User) error { return stop }), stop)
+
+	// Postgres can't store a NUL in text, so the second user fails, and the first isn't created either.
+	_, err = f.db.CreateUsers(t.Context(), []*User{{Name: "Dave"}, {Name: "E\x00ve"}})
+	require.Error(t, err)
+	page, err := f.db.GetUsers(t.Context(), UserQuery{})
+	require.NoError(t, err)
+	assert.Len(t, page.Items, 3)
+}
+
+// TestUsersContext validates that queries stop when their context is cancelled or the query timeout passes.
+func TestUsersContext(t *testing.T) {
+	t.Parallel()
+	f := NewFixture(t)
+	defer f.Cleanup()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err := f.db.GetUsers(ctx, UserQuery{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	f.db.conf.QueryTimeout = time.Nanosecond
+	_, err = f.db.CreateUser(t.Context(), &User{Name: "Tim"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
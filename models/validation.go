@@ -0,0 +1,30 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ValidationErrors maps the names of invalid fields, as clients know them (e.g. "name"), to what's wrong with them.
+type ValidationErrors map[string]string
+
+func (ve ValidationErrors) Error() string {
+	fields := make([]string, 0, len(ve))
+	for field := range ve {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = fmt.Sprintf("%s %s", field, ve[field])
+	}
+	return "invalid " + strings.Join(msgs, "; ")
+}
+
+// Validator is implemented by models that can check their fields before being saved. Validate returns nil (or an empty
+// map) when everything is valid.
+type Validator interface {
+	Validate() ValidationErrors
+}
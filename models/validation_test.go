@@ -0,0 +1,19 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUserValidate validates that user names must be present and not too long, and how validation errors read.
+func TestUserValidate(t *testing.T) {
+	assert.Nil(t, (&User{Name: "Tim"}).Validate())
+	assert.Equal(t, ValidationErrors{"name": "must not be blank"}, (&User{Name: " \t"}).Validate())
+	assert.Contains(t, (&User{Name: strings.Repeat("é", MaxNameLength+1)}).Validate(), "name")
+	assert.Nil(t, (&User{Name: strings.Repeat("é", MaxNameLength)}).Validate())
+
+	errs := ValidationErrors{"name": "must not be blank", "email": "is invalid"}
+	assert.Equal(t, "invalid email is invalid; name must not be blank", errs.Error())
+}
@@ -4,5 +4,89 @@ CREATE SCHEMA IF NOT EXISTS public;
 -- Create "users" table
 CREATE TABLE users (
   id BIGSERIAL PRIMARY KEY,
-  name text NULL
+  name text NOT NULL,
+  email text NOT NULL DEFAULT '',
+  avatar_url text NOT NULL DEFAULT '',
+  disabled boolean NOT NULL DEFAULT false,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  updated_at timestamptz NOT NULL DEFAULT now(),
+  last_login_at timestamptz
 );
+
+-- Create index "users_email_idx" to table: "users"
+CREATE UNIQUE INDEX users_email_idx ON users (lower(email)) WHERE email <> '';
+
+-- Create "identities" table
+CREATE TABLE identities (
+  provider text NOT NULL,
+  provider_user_id text NOT NULL,
+  user_id bigint NOT NULL,
+  email text NOT NULL DEFAULT '',
+  created_at timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (provider, provider_user_id),
+  CONSTRAINT identities_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Create index "identities_user_id_idx" to table: "identities"
+CREATE INDEX identities_user_id_idx ON identities (user_id);
+
+-- Create "roles" table
+CREATE TABLE roles (
+  name text PRIMARY KEY,
+  description text NOT NULL DEFAULT ''
+);
+
+-- Create "role_permissions" table
+CREATE TABLE role_permissions (
+  role text NOT NULL,
+  permission text NOT NULL,
+  PRIMARY KEY (role, permission),
+  CONSTRAINT role_permissions_role_fkey FOREIGN KEY (role) REFERENCES roles (name) ON DELETE CASCADE
+);
+
+-- Create "user_roles" table
+CREATE TABLE user_roles (
+  user_id bigint NOT NULL,
+  role text NOT NULL,
+  PRIMARY KEY (user_id, role),
+  CONSTRAINT user_roles_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+  CONSTRAINT user_roles_role_fkey FOREIGN KEY (role) REFERENCES roles (name) ON DELETE CASCADE
+);
+
+-- Create index "user_roles_role_idx" to table: "user_roles"
+CREATE INDEX user_roles_role_idx ON user_roles (role);
+
+-- Create "sessions" table
+CREATE TABLE sessions (
+  id text PRIMARY KEY,
+  data bytea NOT NULL,
+  owner text,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  expires_at timestamptz NOT NULL
+);
+
+-- Create index "sessions_owner_idx" to table: "sessions"
+CREATE INDEX sessions_owner_idx ON sessions (owner);
+
+-- Create index "sessions_expires_at_idx" to table: "sessions"
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+
+-- Create "api_tokens" table
+CREATE TABLE api_tokens (
+  id BIGSERIAL PRIMARY KEY,
+  user_id bigint NOT NULL,
+  name text NOT NULL,
+  hint text NOT NULL,
+  token_hash bytea NOT NULL,
+  scopes text NOT NULL DEFAULT '',
+  created_at timestamptz NOT NULL DEFAULT now(),
+  expires_at timestamptz,
+  last_used_at timestamptz,
+  CONSTRAINT api_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Create index "api_tokens_token_hash_idx" to table: "api_tokens"
+CREATE UNIQUE INDEX api_tokens_token_hash_idx ON api_tokens (token_hash);
+
+-- Create index "api_tokens_user_id_idx" to table: "api_tokens"
+CREATE INDEX api_tokens_user_id_idx ON api_tokens (user_id);